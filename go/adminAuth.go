@@ -0,0 +1,28 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// adminAuth 管理用のエンドポイントを Authorization: Bearer <token> で守るミドルウェア
+// token が空のときは管理用のエンドポイントを無効にし、全てのリクエストを断る
+func adminAuth(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if token == "" {
+				return c.JSON(http.StatusForbidden, ErrorResponse{Message: "admin endpoints are disabled"})
+			}
+			auth := c.Request().Header.Get(echo.HeaderAuthorization)
+			const prefix = "Bearer "
+			if !strings.HasPrefix(auth, prefix) || subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) != 1 {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return c.JSON(http.StatusUnauthorized, ErrorResponse{Message: "invalid admin token"})
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func doAdminRequest(e *echo.Echo, method, path, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if authorization != "" {
+		req.Header.Set(echo.HeaderAuthorization, authorization)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminEndpointsRequireToken(t *testing.T) {
+	_, e := newTestServer(t)
+	expectStatus(t, uploadCSV(e, "/api/estate", "estates", estateCSVRow(1, 40000, 100, 100, 35.0, 139.0)), http.StatusCreated)
+	expectStatus(t, doJSON(e, http.MethodPost, "/api/estate/req_doc/1", map[string]string{"email": "a@example.com"}), http.StatusOK)
+
+	endpoints := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/admin/document_requests"},
+		{http.MethodPost, "/admin/document_requests/1/status?status=done"},
+		{http.MethodGet, "/debug/estate_index"},
+		{http.MethodGet, "/debug/cache_stats"},
+		{http.MethodGet, "/api/orders?email=a@example.com"},
+		{http.MethodGet, "/api/chair/1/orders"},
+	}
+	for _, ep := range endpoints {
+		for _, auth := range []string{"", "Bearer wrong", "Basic " + testAdminToken, testAdminToken, "Bearer " + testAdminToken + "x"} {
+			if rec := doAdminRequest(e, ep.method, ep.path, auth); rec.Code != http.StatusUnauthorized {
+				t.Errorf("%v %v with %q: status = %v, want %v", ep.method, ep.path, auth, rec.Code, http.StatusUnauthorized)
+			}
+		}
+	}
+
+	rec := doAdminRequest(e, http.MethodGet, "/admin/document_requests", "Bearer "+testAdminToken)
+	expectStatus(t, rec, http.StatusOK)
+	var res DocumentRequestListResponse
+	decode(t, rec, &res)
+	if res.Count != 1 {
+		t.Fatalf("document requests = %+v", res)
+	}
+	expectStatus(t, doAdminRequest(e, http.MethodGet, "/debug/cache_stats", "Bearer "+testAdminToken), http.StatusOK)
+
+	// 管理用でないエンドポイントにはトークンはいらない
+	expectStatus(t, doRequest(e, http.MethodGet, "/api/estate/1", nil, ""), http.StatusOK)
+}
+
+func TestAdminEndpointsDisabledWithoutToken(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.adminToken = ""
+	e := echo.New()
+	s.registerRoutes(e)
+
+	for _, auth := range []string{"", "Bearer ", "Bearer " + testAdminToken} {
+		if rec := doAdminRequest(e, http.MethodGet, "/admin/document_requests", auth); rec.Code != http.StatusForbidden {
+			t.Errorf("with %q: status = %v, want %v", auth, rec.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestOrderHistoryRequiresAdminToken(t *testing.T) {
+	_, e := newTestServer(t)
+	expectStatus(t, uploadCSV(e, "/api/chair", "chairs", chairCSVRow(1, 2000, 2)), http.StatusCreated)
+	expectStatus(t, doJSON(e, http.MethodPost, "/api/chair/buy/1", map[string]string{"email": "a@example.com"}), http.StatusOK)
+
+	for _, path := range []string{"/api/orders?email=a@example.com", "/api/chair/1/orders"} {
+		expectStatus(t, doRequest(e, http.MethodGet, path, nil, ""), http.StatusUnauthorized)
+
+		rec := doAdminRequest(e, http.MethodGet, path, "Bearer "+testAdminToken)
+		expectStatus(t, rec, http.StatusOK)
+		var orders OrderListResponse
+		decode(t, rec, &orders)
+		if orders.Count != 1 || orders.Orders[0].Email != "a@example.com" {
+			t.Fatalf("%v: orders = %+v", path, orders)
+		}
+	}
+}
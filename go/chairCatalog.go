@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// chairLockStripes chairLocks の数
+const chairLockStripes = 64
+
+// chairCatalog 椅子を全てメモリ上に持ち、読み込みはメモリから返す ChairStore
+// 書き込みは MySQL に書いてからメモリに反映する
+type chairCatalog struct {
+	db *mysqlChairStore
+
+	// writeMu 初期化や取り込みのように全ての椅子を書き換える書き込みは Lock を、椅子ごとの書き込みは RLock を取る
+	writeMu sync.RWMutex
+	// chairLocks 同じ椅子への書き込みだけを直列化し、MySQL とメモリへの反映の順序を揃える。椅子 ID の剰余で選ぶ
+	chairLocks [chairLockStripes]sync.Mutex
+
+	mu     sync.RWMutex
+	chairs map[int64]*Chair
+	// byPrice 在庫のある椅子を price ASC, id ASC で並べたもの
+	byPrice []*Chair
+	// byPopularity 在庫のある椅子を popularity DESC, id ASC で並べたもの
+	byPopularity []*Chair
+}
+
+func newChairCatalog(db *mysqlChairStore) *chairCatalog {
+	return &chairCatalog{db: db, chairs: map[int64]*Chair{}}
+}
+
+// load chair テーブルの内容でメモリ上の椅子を置き換える
+func (s *chairCatalog) load(ctx context.Context) error {
+	chairs, err := s.db.selectAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.chairs = make(map[int64]*Chair, len(chairs))
+	for i := range chairs {
+		s.chairs[chairs[i].ID] = &chairs[i]
+	}
+	s.rebuildViews()
+	return nil
+}
+
+// rebuildViews 在庫のある椅子の並び順を作り直す。s.mu を取った状態で呼ぶ
+func (s *chairCatalog) rebuildViews() {
+	inStock := make([]*Chair, 0, len(s.chairs))
+	for _, chair := range s.chairs {
+		if chair.Stock > 0 {
+			inStock = append(inStock, chair)
+		}
+	}
+
+	s.byPrice = make([]*Chair, len(inStock))
+	copy(s.byPrice, inStock)
+	sort.Slice(s.byPrice, func(i, j int) bool {
+		if s.byPrice[i].Price != s.byPrice[j].Price {
+			return s.byPrice[i].Price < s.byPrice[j].Price
+		}
+		return s.byPrice[i].ID < s.byPrice[j].ID
+	})
+
+	s.byPopularity = inStock
+	sort.Slice(s.byPopularity, func(i, j int) bool {
+		if s.byPopularity[i].Popularity != s.byPopularity[j].Popularity {
+			return s.byPopularity[i].Popularity > s.byPopularity[j].Popularity
+		}
+		return s.byPopularity[i].ID < s.byPopularity[j].ID
+	})
+}
+
+// removeFromViews 在庫の無くなった椅子を並び順から取り除く。s.mu を取った状態で呼ぶ
+func (s *chairCatalog) removeFromViews(id int64) {
+	remove := func(view []*Chair) []*Chair {
+		for i, chair := range view {
+			if chair.ID == id {
+				return append(view[:i], view[i+1:]...)
+			}
+		}
+		return view
+	}
+	s.byPrice = remove(s.byPrice)
+	s.byPopularity = remove(s.byPopularity)
+}
+
+// lockChairs ids の椅子への書き込みを始め、終えるための関数を返す
+// 別の椅子への書き込みは並行して進められる。複数の椅子を扱ってもデッドロックしないよう、ロックは番号順に取る
+func (s *chairCatalog) lockChairs(ids ...int64) func() {
+	s.writeMu.RLock()
+	stripes := make([]int, 0, len(ids))
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		i := int(uint64(id) % chairLockStripes)
+		if !seen[i] {
+			seen[i] = true
+			stripes = append(stripes, i)
+		}
+	}
+	sort.Ints(stripes)
+	for _, i := range stripes {
+		s.chairLocks[i].Lock()
+	}
+	return func() {
+		for _, i := range stripes {
+			s.chairLocks[i].Unlock()
+		}
+		s.writeMu.RUnlock()
+	}
+}
+
+func (s *chairCatalog) Initialize(ctx context.Context) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if err := s.db.Initialize(ctx); err != nil {
+		return err
+	}
+	return s.load(ctx)
+}
+
+func (s *chairCatalog) GetChair(ctx context.Context, id int64) (*Chair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chair, ok := s.chairs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *chair
+	return &c, nil
+}
+
+// catalogChairImporter MySQL に書き込み、コミットしてからメモリ上の椅子を読み直す
+type catalogChairImporter struct {
+	ChairImporter
+	s *chairCatalog
+}
+
+// ImportChairs 取り込みの間も購入は止めず、行ロックで MySQL 側の順序を保つ
+func (s *chairCatalog) ImportChairs(ctx context.Context, mode ImportMode) (ChairImporter, error) {
+	importer, err := s.db.ImportChairs(ctx, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &catalogChairImporter{ChairImporter: importer, s: s}, nil
+}
+
+// Commit 取り込んだ行を待っている購入があるので、writeMu はコミットしてから取る
+// 購入が終わるのを待ってから読み直すので、その購入もメモリに反映される
+func (i *catalogChairImporter) Commit(ctx context.Context) (ImportSummary, error) {
+	summary, err := i.ChairImporter.Commit(ctx)
+	if err != nil {
+		return ImportSummary{}, err
+	}
+
+	i.s.writeMu.Lock()
+	defer i.s.writeMu.Unlock()
+
+	if err := i.s.load(ctx); err != nil {
+		return ImportSummary{}, err
+	}
+	return summary, nil
+}
+
+// ExportChairs 書き出しの間に書き込みを止めないよう、条件に合う椅子を写してから fn に渡す
+func (s *chairCatalog) ExportChairs(ctx context.Context, q ChairSearchQuery, fn func(Chair) error) error {
+	s.mu.RLock()
+	found := make([]Chair, 0)
+	for _, chair := range s.chairs {
+		if q.matchFilters(chair) {
+			found = append(found, *chair)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(found, func(i, j int) bool { return found[i].ID < found[j].ID })
+	for _, chair := range found {
+		if err := fn(chair); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *chairCatalog) SearchChairs(ctx context.Context, q ChairSearchQuery) (int64, []Chair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	from, to := q.Page*q.PerPage, (q.Page+1)*q.PerPage
+	var count int64
+	chairs := []Chair{}
+	for _, chair := range s.byPopularity {
+		if !q.match(chair) {
+			continue
+		}
+		if from <= int(count) && int(count) < to {
+			chairs = append(chairs, *chair)
+		}
+		count++
+	}
+	return count, chairs, nil
+}
+
+func (s *chairCatalog) LowPricedChairs(ctx context.Context, limit int) ([]Chair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if limit > len(s.byPrice) {
+		limit = len(s.byPrice)
+	}
+	chairs := make([]Chair, 0, limit)
+	for _, chair := range s.byPrice[:limit] {
+		chairs = append(chairs, *chair)
+	}
+	return chairs, nil
+}
+
+func (s *chairCatalog) BuyChair(ctx context.Context, id int64, email string) (*Order, error) {
+	defer s.lockChairs(id)()
+
+	// この椅子への書き込みは lockChairs で直列化しているので、ここで引いた chair は他から書き換えられない
+	s.mu.RLock()
+	chair, ok := s.chairs[id]
+	inStock := ok && chair.Stock > 0
+	s.mu.RUnlock()
+	if !inStock {
+		return nil, ErrNotFound
+	}
+
+	order, err := s.db.BuyChair(ctx, id, email)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == ErrNotFound {
+		// MySQL 側で在庫が尽きていたのでメモリも合わせる
+		chair.Stock = 0
+	} else {
+		chair.Stock--
+	}
+	if chair.Stock <= 0 {
+		s.removeFromViews(id)
+	}
+	return order, err
+}
+
+func (s *chairCatalog) Checkout(ctx context.Context, email string, cart []CartItem) ([]Order, error) {
+	ids := make([]int64, 0, len(cart))
+	for _, item := range cart {
+		ids = append(ids, item.ChairID)
+	}
+	defer s.lockChairs(ids...)()
+
+	orders, err := s.db.Checkout(ctx, email, cart)
+	if err != nil {
+		if e, ok := err.(*InsufficientStockError); ok {
+			// MySQL 側の在庫にメモリを合わせる
+			s.mu.Lock()
+			for _, short := range e.Items {
+				if chair, ok := s.chairs[short.ChairID]; ok {
+					chair.Stock = short.Available
+					if chair.Stock <= 0 {
+						s.removeFromViews(chair.ID)
+					}
+				}
+			}
+			s.mu.Unlock()
+		}
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, item := range cart {
+		if chair, ok := s.chairs[item.ChairID]; ok {
+			chair.Stock -= item.Quantity
+			if chair.Stock <= 0 {
+				s.removeFromViews(chair.ID)
+			}
+		}
+	}
+	return orders, nil
+}
+
+func (s *chairCatalog) ReserveChair(ctx context.Context, r Reservation) error {
+	defer s.lockChairs(r.ChairID)()
+
+	s.mu.RLock()
+	chair, ok := s.chairs[r.ChairID]
+	inStock := ok && chair.Stock > 0
+	s.mu.RUnlock()
+	if !inStock {
+		return ErrNotFound
+	}
+
+	err := s.db.ReserveChair(ctx, r)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 取り置いた分は在庫から除くので、検索や詳細では在庫切れと同じに見える
+	if err == ErrNotFound {
+		chair.Stock = 0
+	} else {
+		chair.Stock--
+	}
+	if chair.Stock <= 0 {
+		s.removeFromViews(chair.ID)
+	}
+	return err
+}
+
+// BuyReservedChair 在庫は取り置いたときに減らしているので、メモリは変わらない
+func (s *chairCatalog) BuyReservedChair(ctx context.Context, token string, id int64, email string) (*Order, error) {
+	defer s.lockChairs(id)()
+
+	return s.db.BuyReservedChair(ctx, token, id, email)
+}
+
+// ReleaseExpiredReservations 期限切れの取り置きを先に読み、その椅子への書き込みだけを止めて在庫に戻す
+// 読んでからロックするまでに購入された取り置きは releaseReservations が除く
+func (s *chairCatalog) ReleaseExpiredReservations(ctx context.Context, now time.Time) (int, error) {
+	expired, err := s.db.selectExpiredReservations(ctx, now)
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+	ids := make([]int64, 0, len(expired))
+	for _, r := range expired {
+		ids = append(ids, r.ChairID)
+	}
+	defer s.lockChairs(ids...)()
+
+	released, err := s.db.releaseReservations(ctx, expired, now)
+	if err != nil || len(released) == 0 {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, count := range released {
+		if chair, ok := s.chairs[id]; ok {
+			chair.Stock += count
+		}
+		n += int(count)
+	}
+	// 在庫切れだった椅子が戻ってくるので並び順を作り直す
+	s.rebuildViews()
+	return n, nil
+}
+
+// OrdersByEmail 購入記録はメモリに持たないので MySQL から読む
+func (s *chairCatalog) OrdersByEmail(ctx context.Context, email string, page, perPage int) (int64, []Order, error) {
+	return s.db.OrdersByEmail(ctx, email, page, perPage)
+}
+
+// OrdersByChair 購入記録はメモリに持たないので MySQL から読む
+func (s *chairCatalog) OrdersByChair(ctx context.Context, chairID int64, page, perPage int) (int64, []Order, error) {
+	return s.db.OrdersByChair(ctx, chairID, page, perPage)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockChairsOnlySerializesSameChair(t *testing.T) {
+	s := newChairCatalog(nil)
+	unlock := s.lockChairs(1)
+
+	other := make(chan struct{})
+	go func() {
+		s.lockChairs(2)()
+		close(other)
+	}()
+	select {
+	case <-other:
+	case <-time.After(time.Second):
+		t.Fatal("writing chair 2 waited for chair 1")
+	}
+
+	same := make(chan struct{})
+	go func() {
+		s.lockChairs(1)()
+		close(same)
+	}()
+	select {
+	case <-same:
+		t.Fatal("two writes to chair 1 ran at the same time")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-same
+}
+
+func TestLockChairsDoesNotDeadlock(t *testing.T) {
+	s := newChairCatalog(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				// カートの順序や重複に関わらず番号順にロックを取る
+				if i%2 == 0 {
+					s.lockChairs(1, 2, 3, 1)()
+				} else {
+					s.lockChairs(3, 2, chairLockStripes+1)()
+				}
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("lockChairs deadlocked")
+	}
+}
+
+func TestLockChairsWaitsForWholeCatalogWrites(t *testing.T) {
+	s := newChairCatalog(nil)
+	s.writeMu.Lock()
+	locked := make(chan struct{})
+	go func() {
+		s.lockChairs(1)()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("writing a chair did not wait for the catalog to be reloaded")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.writeMu.Unlock()
+	<-locked
+}
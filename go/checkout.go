@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo"
+)
+
+// CheckoutItemLimit 一度に購入できる椅子の種類の上限
+const CheckoutItemLimit = 100
+
+// CheckoutQuantityLimit 一つの椅子を一度に購入できる数の上限。在庫の stock カラム (INTEGER) の最大値
+const CheckoutQuantityLimit = math.MaxInt32
+
+// CartItem カートに入れた椅子とその数
+type CartItem struct {
+	ChairID  int64 `json:"chairId"`
+	Quantity int64 `json:"quantity"`
+}
+
+// StockShortage 在庫が足りなかった椅子。存在しない椅子は Available を 0 とする
+type StockShortage struct {
+	ChairID   int64 `json:"chairId"`
+	Requested int64 `json:"requested"`
+	Available int64 `json:"available"`
+}
+
+// InsufficientStockError カートのいずれかの椅子の在庫が足りないことを表す
+type InsufficientStockError struct {
+	Items []StockShortage
+}
+
+func (e *InsufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock for %v items", len(e.Items))
+}
+
+type CheckoutRequest struct {
+	Email string     `json:"email"`
+	Items []CartItem `json:"items"`
+}
+
+type CheckoutResponse struct {
+	Orders []Order `json:"orders"`
+}
+
+type CheckoutErrorResponse struct {
+	Message string          `json:"message"`
+	Items   []StockShortage `json:"items"`
+}
+
+// normalizeCart 同じ椅子をまとめて chairId の昇順に並べる
+// 行ロックをこの順で取ることで、同時に購入されてもデッドロックしないようにする
+func normalizeCart(items []CartItem) ([]CartItem, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("items is empty")
+	}
+	quantities := make(map[int64]int64, len(items))
+	for _, item := range items {
+		if item.Quantity <= 0 {
+			return nil, fmt.Errorf("quantity of chair %v must be positive", item.ChairID)
+		}
+		// 上限以下の数を足しているので、合計を確かめる前に int64 が溢れることはない
+		if item.Quantity > CheckoutQuantityLimit || quantities[item.ChairID]+item.Quantity > CheckoutQuantityLimit {
+			return nil, fmt.Errorf("quantity of chair %v is too large (max %v)", item.ChairID, CheckoutQuantityLimit)
+		}
+		quantities[item.ChairID] += item.Quantity
+	}
+	if len(quantities) > CheckoutItemLimit {
+		return nil, fmt.Errorf("too many items (max %v)", CheckoutItemLimit)
+	}
+
+	cart := make([]CartItem, 0, len(quantities))
+	for id, quantity := range quantities {
+		cart = append(cart, CartItem{ChairID: id, Quantity: quantity})
+	}
+	sort.Slice(cart, func(i, j int) bool { return cart[i].ChairID < cart[j].ChairID })
+	return cart, nil
+}
+
+// shortages stocks の在庫で足りない cart の椅子を返す
+func shortages(cart []CartItem, stocks map[int64]int64) []StockShortage {
+	short := make([]StockShortage, 0)
+	for _, item := range cart {
+		if available := stocks[item.ChairID]; available < item.Quantity {
+			short = append(short, StockShortage{ChairID: item.ChairID, Requested: item.Quantity, Available: available})
+		}
+	}
+	return short
+}
+
+func (s *server) checkoutChairs(c echo.Context) error {
+	var req CheckoutRequest
+	if err := c.Bind(&req); err != nil {
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if req.Email == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "email is required"})
+	}
+	cart, err := normalizeCart(req.Items)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+	}
+
+	orders, err := s.chairs.Checkout(c.Request().Context(), req.Email, cart)
+	if err != nil {
+		if e, ok := err.(*InsufficientStockError); ok {
+			return c.JSON(http.StatusConflict, CheckoutErrorResponse{Message: "insufficient stock", Items: e.Items})
+		}
+		c.Logger().Errorf("checkoutChairs DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, CheckoutResponse{Orders: orders})
+}
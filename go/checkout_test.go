@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"testing"
+)
+
+func TestNormalizeCart(t *testing.T) {
+	tooMany := make([]CartItem, 0, CheckoutItemLimit+1)
+	for id := int64(1); id <= CheckoutItemLimit+1; id++ {
+		tooMany = append(tooMany, CartItem{ChairID: id, Quantity: 1})
+	}
+
+	tests := []struct {
+		name  string
+		items []CartItem
+		want  []CartItem
+	}{
+		{"merge and sort", []CartItem{{ChairID: 2, Quantity: 1}, {ChairID: 1, Quantity: 2}, {ChairID: 2, Quantity: 3}}, []CartItem{{ChairID: 1, Quantity: 2}, {ChairID: 2, Quantity: 4}}},
+		{"quantity at limit", []CartItem{{ChairID: 1, Quantity: CheckoutQuantityLimit}}, []CartItem{{ChairID: 1, Quantity: CheckoutQuantityLimit}}},
+		{"sum at limit", []CartItem{{ChairID: 1, Quantity: CheckoutQuantityLimit - 1}, {ChairID: 1, Quantity: 1}}, []CartItem{{ChairID: 1, Quantity: CheckoutQuantityLimit}}},
+		{"empty", []CartItem{}, nil},
+		{"zero quantity", []CartItem{{ChairID: 1, Quantity: 0}}, nil},
+		{"negative quantity", []CartItem{{ChairID: 1, Quantity: -1}}, nil},
+		{"quantity over limit", []CartItem{{ChairID: 1, Quantity: CheckoutQuantityLimit + 1}}, nil},
+		{"sum over limit", []CartItem{{ChairID: 1, Quantity: CheckoutQuantityLimit}, {ChairID: 1, Quantity: 1}}, nil},
+		// 以前は合計が int64 を溢れて負の数になっていた
+		{"sum overflows int64", []CartItem{{ChairID: 1, Quantity: math.MaxInt64}, {ChairID: 1, Quantity: 2}}, nil},
+		{"too many items", tooMany, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeCart(tt.items)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("normalizeCart() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("normalizeCart() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("normalizeCart() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckoutRejectsOverflowingQuantity(t *testing.T) {
+	_, e := newTestServer(t)
+	expectStatus(t, uploadCSV(e, "/api/chair", "chairs", chairCSVRow(1, 1000, 3)), http.StatusCreated)
+
+	rec := doJSON(e, http.MethodPost, "/api/chair/checkout", CheckoutRequest{
+		Email: "a@example.com",
+		Items: []CartItem{{ChairID: 1, Quantity: math.MaxInt64}, {ChairID: 1, Quantity: 2}},
+	})
+	expectStatus(t, rec, http.StatusBadRequest)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/goccy/go-json"
+)
+
+// DBConfig 椅子と物件それぞれのデータベースの接続先
+type DBConfig struct {
+	Chair  *MySQLConnectionEnv
+	Estate *MySQLConnectionEnv
+
+	// ChairReplicas, EstateReplicas 読み込みに使うリードレプリカ。空ならプライマリだけを使う
+	ChairReplicas  []*MySQLConnectionEnv
+	EstateReplicas []*MySQLConnectionEnv
+}
+
+// SharedDatabase 椅子と物件が同じ MySQL の同じデータベースを使うかを返す
+func (c *DBConfig) SharedDatabase() bool {
+	return c.Chair.Host == c.Estate.Host && c.Chair.Port == c.Estate.Port && c.Chair.DBName == c.Estate.DBName
+}
+
+// mysqlConfigFile 設定ファイル中の接続先。空の項目は上書きしない
+type mysqlConfigFile struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	User     string `json:"user"`
+	DBName   string `json:"dbname"`
+	Password string `json:"password"`
+}
+
+// configFile ISUUMO_CONFIG で指定する JSON の設定ファイル
+type configFile struct {
+	Chair  mysqlConfigFile `json:"chair"`
+	Estate mysqlConfigFile `json:"estate"`
+}
+
+// LoadDBConfig 接続先を決める。後に挙げたものほど優先する
+//   - 椅子: MYSQL_* 環境変数 (未指定なら既定値), 設定ファイルの chair
+//   - 物件: 椅子の接続先, MYSQL_ESTATE_* 環境変数, 設定ファイルの estate
+//
+// リードレプリカは MYSQL_REPLICA_HOSTS と MYSQL_ESTATE_REPLICA_HOSTS で指定する
+func LoadDBConfig() (*DBConfig, error) {
+	var file configFile
+	if path := getEnv("ISUUMO_CONFIG", ""); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := json.Unmarshal(b, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %v: %w", path, err)
+		}
+	}
+
+	chair := NewMySQLConnectionEnv()
+	file.Chair.apply(chair)
+
+	estate := NewMySQLEstateConnectionEnv(chair)
+	file.Estate.apply(estate)
+
+	if err := chair.validate(); err != nil {
+		return nil, fmt.Errorf("invalid chair database config: %w", err)
+	}
+	if err := estate.validate(); err != nil {
+		return nil, fmt.Errorf("invalid estate database config: %w", err)
+	}
+
+	config := &DBConfig{
+		Chair:          chair,
+		Estate:         estate,
+		ChairReplicas:  NewMySQLReplicaConnectionEnvs("MYSQL_REPLICA_HOSTS", chair),
+		EstateReplicas: NewMySQLReplicaConnectionEnvs("MYSQL_ESTATE_REPLICA_HOSTS", estate),
+	}
+	for _, replica := range config.ChairReplicas {
+		if err := replica.validate(); err != nil {
+			return nil, fmt.Errorf("invalid chair replica config: %w", err)
+		}
+	}
+	for _, replica := range config.EstateReplicas {
+		if err := replica.validate(); err != nil {
+			return nil, fmt.Errorf("invalid estate replica config: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// NewMySQLEstateConnectionEnv MYSQL_ESTATE_* 環境変数から物件データベースの接続先を作る。未指定の項目は chair と同じにする
+func NewMySQLEstateConnectionEnv(chair *MySQLConnectionEnv) *MySQLConnectionEnv {
+	return &MySQLConnectionEnv{
+		Host:     getEnv("MYSQL_ESTATE_HOST", chair.Host),
+		Port:     getEnv("MYSQL_ESTATE_PORT", chair.Port),
+		User:     getEnv("MYSQL_ESTATE_USER", chair.User),
+		DBName:   getEnv("MYSQL_ESTATE_DBNAME", chair.DBName),
+		Password: getEnv("MYSQL_ESTATE_PASS", chair.Password),
+	}
+}
+
+func (f mysqlConfigFile) apply(mc *MySQLConnectionEnv) {
+	if f.Host != "" {
+		mc.Host = f.Host
+	}
+	if f.Port != "" {
+		mc.Port = f.Port
+	}
+	if f.User != "" {
+		mc.User = f.User
+	}
+	if f.DBName != "" {
+		mc.DBName = f.DBName
+	}
+	if f.Password != "" {
+		mc.Password = f.Password
+	}
+}
+
+func (mc *MySQLConnectionEnv) validate() error {
+	if mc.Host == "" {
+		return fmt.Errorf("host is empty")
+	}
+	if port, err := strconv.Atoi(mc.Port); err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("port %q is not a valid port number", mc.Port)
+	}
+	if mc.User == "" {
+		return fmt.Errorf("user is empty")
+	}
+	// /initialize のスクリプトはデータベース名を決め打ちしているので、別の名前では初期化したものと違うデータベースを読んでしまう
+	if mc.DBName != sqlScriptDBName {
+		return fmt.Errorf("dbname %q is not supported, the initialize scripts create %q", mc.DBName, sqlScriptDBName)
+	}
+	return nil
+}
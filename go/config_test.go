@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// setEnv テストの間だけ環境変数を設定する
+func setEnv(t *testing.T, key, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestLoadDBConfigSharedDatabase(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		shared bool
+	}{
+		{"defaults", nil, true},
+		{"same host by env", map[string]string{"MYSQL_HOST": "db", "MYSQL_ESTATE_HOST": "db"}, true},
+		{"separate host", map[string]string{"MYSQL_ESTATE_HOST": "10.0.0.2"}, false},
+		{"separate port", map[string]string{"MYSQL_ESTATE_PORT": "3307"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				setEnv(t, key, value)
+			}
+			config, err := LoadDBConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := config.SharedDatabase(); got != tt.shared {
+				t.Fatalf("SharedDatabase() = %v, want %v", got, tt.shared)
+			}
+		})
+	}
+}
+
+func TestLoadDBConfigRejectsOtherDBName(t *testing.T) {
+	for _, key := range []string{"MYSQL_DBNAME", "MYSQL_ESTATE_DBNAME"} {
+		t.Run(key, func(t *testing.T) {
+			setEnv(t, key, "other")
+			if _, err := LoadDBConfig(); err == nil || !strings.Contains(err.Error(), "other") {
+				t.Fatalf("LoadDBConfig() error = %v", err)
+			}
+		})
+	}
+}
+
+// initializeRecorder Initialize が呼ばれた順と、重なって呼ばれたかを記録する
+type initializeRecorder struct {
+	calls   []string
+	running int
+	overlap bool
+}
+
+func (r *initializeRecorder) run(name string) {
+	r.running++
+	if r.running > 1 {
+		r.overlap = true
+	}
+	r.calls = append(r.calls, name)
+	r.running--
+}
+
+type recordingInitChairStore struct {
+	*memoryChairStore
+	r *initializeRecorder
+}
+
+func (s *recordingInitChairStore) Initialize(ctx context.Context) error {
+	s.r.run("chair")
+	return s.memoryChairStore.Initialize(ctx)
+}
+
+type recordingInitEstateStore struct {
+	*memoryEstateStore
+	r *initializeRecorder
+}
+
+func (s *recordingInitEstateStore) Initialize(ctx context.Context) error {
+	s.r.run("estate")
+	return s.memoryEstateStore.Initialize(ctx)
+}
+
+func TestInitializeSharedDatabaseRunsInOrder(t *testing.T) {
+	s, e := newTestServer(t)
+	r := &initializeRecorder{}
+	s.chairs = &recordingInitChairStore{memoryChairStore: newMemoryChairStore(), r: r}
+	s.estates = &recordingInitEstateStore{memoryEstateStore: newMemoryEstateStore(), r: r}
+	s.sharedDatabase = true
+
+	expectStatus(t, doRequest(e, http.MethodPost, "/initialize", nil, ""), http.StatusOK)
+	if strings.Join(r.calls, ",") != "chair,estate" || r.overlap {
+		t.Fatalf("calls = %v, overlap = %v", r.calls, r.overlap)
+	}
+}
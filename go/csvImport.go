@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultImportChunkSize = 1000
+	defaultImportMaxRows   = 200000
+	defaultImportMaxBytes  = 64 << 20
+
+	// multipartOverhead multipart の境界やヘッダの分としてファイルの上限に足すバイト数
+	multipartOverhead = 1 << 20
+	// maxPlaceholders MySQL の一つの文で使えるプレースホルダの上限
+	maxPlaceholders = 65535
+)
+
+// errUploadTooLarge アップロードされた CSV が行数かバイト数の上限を超えたことを表す
+var errUploadTooLarge = errors.New("upload too large")
+
+// csvImportConfig postChair / postEstate で CSV を取り込むときの設定
+type csvImportConfig struct {
+	// ChunkSize アップロードを読みながら一度に書き込む行数。一つの INSERT 文で挿入する行数でもある
+	ChunkSize int
+	// MaxRows, MaxBytes 一回のアップロードで受け付ける行数とバイト数の上限
+	MaxRows  int
+	MaxBytes int64
+}
+
+// loadCSVImportConfig CSV_IMPORT_CHUNK_SIZE, CSV_IMPORT_MAX_ROWS, CSV_IMPORT_MAX_BYTES 環境変数から取り込みの設定を作る
+func loadCSVImportConfig() (csvImportConfig, error) {
+	chunkSize, err := getPositiveIntEnv("CSV_IMPORT_CHUNK_SIZE", defaultImportChunkSize)
+	if err != nil {
+		return csvImportConfig{}, err
+	}
+	maxRows, err := getPositiveIntEnv("CSV_IMPORT_MAX_ROWS", defaultImportMaxRows)
+	if err != nil {
+		return csvImportConfig{}, err
+	}
+	maxBytes, err := getPositiveIntEnv("CSV_IMPORT_MAX_BYTES", defaultImportMaxBytes)
+	if err != nil {
+		return csvImportConfig{}, err
+	}
+	return csvImportConfig{ChunkSize: chunkSize, MaxRows: maxRows, MaxBytes: int64(maxBytes)}, nil
+}
+
+func getPositiveIntEnv(key string, defaultValue int) (int, error) {
+	v := getEnv(key, "")
+	if v == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %v %q", key, v)
+	}
+	return n, nil
+}
+
+// limitedReader n バイトを超えて読もうとしたら errUploadTooLarge を返す
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// 上限ちょうどで終わっているかを確かめる
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, errUploadTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// openUpload フォームの name のファイルを開く。ファイルが大きすぎる場合は errUploadTooLarge を返す
+func (cfg csvImportConfig) openUpload(c echo.Context, name string) (io.ReadCloser, error) {
+	req := c.Request()
+	if req.ContentLength > cfg.MaxBytes+multipartOverhead {
+		return nil, errUploadTooLarge
+	}
+	// Content-Length がない場合もフォームの読み込みで上限を超えないようにする
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, cfg.MaxBytes+multipartOverhead)
+
+	header, err := c.FormFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if header.Size > cfg.MaxBytes {
+		return nil, errUploadTooLarge
+	}
+	return header.Open()
+}
+
+// readCSV r の CSV を一行ずつ読んで、行番号とともに row に渡す。MaxRows 行か MaxBytes バイトを超えたら errUploadTooLarge を返す
+// 行番号は 1 から数えたレコードの番号で、改行を含むフィールドがなければファイルの行番号と一致する
+// 列数は行ごとに row 側で確かめる。CSV として読めない場合は *csv.ParseError を返す
+func (cfg csvImportConfig) readCSV(r io.Reader, row func(line int, rm *RecordMapper) error) error {
+	cr := csv.NewReader(&limitedReader{r: r, n: cfg.MaxBytes})
+	cr.ReuseRecord = true
+	cr.FieldsPerRecord = -1
+	for rows := 0; ; rows++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if errors.Is(err, errUploadTooLarge) {
+				return errUploadTooLarge
+			}
+			return err
+		}
+		if rows >= cfg.MaxRows {
+			return errUploadTooLarge
+		}
+		if err := row(rows+1, &RecordMapper{Record: record}); err != nil {
+			return err
+		}
+	}
+}
+
+// insertChunked values を columns 列ずつの行として、head に続く VALUES 句で chunk 行ずつ挿入する
+// 一つの文のプレースホルダが maxPlaceholders を超えないよう chunk を抑える
+func insertChunked(ctx context.Context, tx sqlx.ExecerContext, head string, columns int, values []interface{}, chunk int) error {
+	if chunk > maxPlaceholders/columns {
+		chunk = maxPlaceholders / columns
+	}
+	row := make([]byte, 0, columns*3+2)
+	row = append(row, '(')
+	for i := 0; i < columns; i++ {
+		if i > 0 {
+			row = append(row, ", "...)
+		}
+		row = append(row, '?')
+	}
+	row = append(row, ')')
+
+	for start := 0; start < len(values); start += chunk * columns {
+		end := start + chunk*columns
+		if end > len(values) {
+			end = len(values)
+		}
+		query := bytes.NewBufferString(head)
+		query.WriteString(" VALUES ")
+		for i := start; i < end; i += columns {
+			if i > start {
+				query.WriteByte(',')
+			}
+			query.Write(row)
+		}
+		if _, err := tx.ExecContext(ctx, query.String(), values[start:end]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachChunk ids を chunk 個ずつに分けて fn に渡す
+func forEachChunk(ids []int64, chunk int, fn func(ids []int64) error) error {
+	if chunk > maxPlaceholders {
+		chunk = maxPlaceholders
+	}
+	for start := 0; start < len(ids); start += chunk {
+		end := start + chunk
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := fn(ids[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execInChunked IN (?) を一つ含む query を、ids を chunk 個ずつ渡して実行する
+func execInChunked(ctx context.Context, tx sqlx.ExecerContext, query string, ids []int64, chunk int) error {
+	return forEachChunk(ids, chunk, func(ids []int64) error {
+		q, params, err := sqlx.In(query, ids)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, q, params...)
+		return err
+	})
+}
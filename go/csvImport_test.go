@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// recordingExecer 実行した文を記録するだけの sqlx.ExecerContext
+type recordingExecer struct {
+	queries []string
+	args    [][]interface{}
+}
+
+func (e *recordingExecer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	e.queries = append(e.queries, query)
+	e.args = append(e.args, args)
+	return nil, nil
+}
+
+func TestInsertChunked(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns int
+		rows    int
+		chunk   int
+		want    []int
+	}{
+		{"empty", 18, 0, 1000, nil},
+		{"one statement", 18, 10, 1000, []int{10}},
+		{"exact chunks", 2, 2000, 1000, []int{1000, 1000}},
+		{"last chunk is short", 18, 2500, 1000, []int{1000, 1000, 500}},
+		// 65535 / 18 = 3640 行で一つの文のプレースホルダが上限に達する
+		{"capped by placeholders", 18, 10000, 10000, []int{3640, 3640, 2720}},
+		{"capped for narrow rows", 2, 70000, 100000, []int{32767, 32767, 4466}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := make([]interface{}, 0, tt.rows*tt.columns)
+			for i := 0; i < tt.rows*tt.columns; i++ {
+				values = append(values, i)
+			}
+			e := &recordingExecer{}
+			if err := insertChunked(context.Background(), e, "INSERT INTO t", tt.columns, values, tt.chunk); err != nil {
+				t.Fatal(err)
+			}
+			if len(e.queries) != len(tt.want) {
+				t.Fatalf("%v statements, want %v", len(e.queries), len(tt.want))
+			}
+			next := 0
+			for i, query := range e.queries {
+				rows := strings.Count(query, "(")
+				placeholders := strings.Count(query, "?")
+				if rows != tt.want[i] || placeholders != rows*tt.columns || len(e.args[i]) != placeholders {
+					t.Fatalf("statement %v has %v rows, %v placeholders and %v args, want %v rows", i, rows, placeholders, len(e.args[i]), tt.want[i])
+				}
+				if placeholders > maxPlaceholders {
+					t.Fatalf("statement %v has %v placeholders", i, placeholders)
+				}
+				// 値は順番どおりに一度ずつ渡す
+				for _, arg := range e.args[i] {
+					if arg != next {
+						t.Fatalf("statement %v got arg %v, want %v", i, arg, next)
+					}
+					next++
+				}
+			}
+			if len(e.queries) > 0 && !strings.HasPrefix(e.queries[0], "INSERT INTO t VALUES (?") {
+				t.Fatalf("query = %q", e.queries[0])
+			}
+		})
+	}
+}
+
+func TestExecInChunked(t *testing.T) {
+	ids := make([]int64, 0, 2500)
+	for id := int64(1); id <= 2500; id++ {
+		ids = append(ids, id)
+	}
+	e := &recordingExecer{}
+	if err := execInChunked(context.Background(), e, "DELETE FROM chair WHERE id IN (?)", ids, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.args) != 3 || len(e.args[0]) != 1000 || len(e.args[2]) != 500 {
+		t.Fatalf("executed %v statements", len(e.args))
+	}
+
+	e = &recordingExecer{}
+	if err := execInChunked(context.Background(), e, "DELETE FROM chair WHERE id IN (?)", nil, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.queries) != 0 {
+		t.Fatalf("executed %v statements for no ids", len(e.queries))
+	}
+}
+
+// batchRecordingChairStore 取り込みで Write に渡された行数を記録する
+type batchRecordingChairStore struct {
+	*memoryChairStore
+	batches []int
+}
+
+func (s *batchRecordingChairStore) ImportChairs(ctx context.Context, mode ImportMode) (ChairImporter, error) {
+	importer, err := s.memoryChairStore.ImportChairs(ctx, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &batchRecordingImporter{ChairImporter: importer, s: s}, nil
+}
+
+type batchRecordingImporter struct {
+	ChairImporter
+	s *batchRecordingChairStore
+}
+
+func (i *batchRecordingImporter) Write(ctx context.Context, chairs []Chair) error {
+	i.s.batches = append(i.s.batches, len(chairs))
+	return i.ChairImporter.Write(ctx, chairs)
+}
+
+// newBatchTestServer ChunkSize を chunk にし、書き込みの単位を記録するサーバーを作る
+func newBatchTestServer(t *testing.T, chunk int) (*server, *batchRecordingChairStore, *echo.Echo) {
+	t.Helper()
+	s, e := newTestServer(t)
+	store := &batchRecordingChairStore{memoryChairStore: newMemoryChairStore()}
+	s.chairs = store
+	s.csvImport.ChunkSize = chunk
+	return s, store, e
+}
+
+func chairCSVRows(from, to int64) string {
+	var rows strings.Builder
+	for id := from; id <= to; id++ {
+		rows.WriteString(chairCSVRow(id, 1000, 1))
+	}
+	return rows.String()
+}
+
+func TestPostChairWritesLargeUploadInBatches(t *testing.T) {
+	_, store, e := newBatchTestServer(t, defaultImportChunkSize)
+
+	rec := uploadCSV(e, "/api/chair", "chairs", chairCSVRows(1, 100000))
+	expectStatus(t, rec, http.StatusCreated)
+	var report ImportReport
+	decode(t, rec, &report)
+	if report.Rows != 100000 || report.Summary == nil || report.Summary.Inserted != 100000 {
+		t.Fatalf("report = %+v", report)
+	}
+	if len(store.batches) != 100 {
+		t.Fatalf("%v batches, want 100", len(store.batches))
+	}
+	for i, n := range store.batches {
+		if n != defaultImportChunkSize {
+			t.Fatalf("batch %v has %v rows, want %v", i, n, defaultImportChunkSize)
+		}
+	}
+	for _, id := range []int64{1, 50000, 100000} {
+		if _, err := store.GetChair(context.Background(), id); err != nil {
+			t.Fatalf("chair %v: %v", id, err)
+		}
+	}
+}
+
+func TestPostChairRollsBackWrittenBatches(t *testing.T) {
+	_, store, e := newBatchTestServer(t, 2)
+
+	// 5 行を 2 行ずつ書き込んだ後で問題のある行が見つかる
+	rows := chairCSVRows(1, 5) + strings.Replace(chairCSVRow(6, 1000, 1), "黒", "虹色", 1) + chairCSVRows(7, 9)
+	rec := uploadCSV(e, "/api/chair", "chairs", rows)
+	expectStatus(t, rec, http.StatusBadRequest)
+	var report ImportReport
+	decode(t, rec, &report)
+	if report.Rows != 9 || report.ErrorCount != 1 || report.Errors[0].Line != 6 {
+		t.Fatalf("report = %+v", report)
+	}
+	if fmt.Sprint(store.batches) != "[2 2]" {
+		t.Fatalf("batches = %v, want [2 2]", store.batches)
+	}
+	if _, err := store.GetChair(context.Background(), 1); err != ErrNotFound {
+		t.Fatalf("chair 1 was committed despite the invalid row: %v", err)
+	}
+}
+
+func TestPostChairReportsExistingIDsInInsertMode(t *testing.T) {
+	_, store, e := newBatchTestServer(t, 2)
+	expectStatus(t, uploadCSV(e, "/api/chair", "chairs", chairCSVRow(3, 1000, 1)), http.StatusCreated)
+
+	rec := uploadCSV(e, "/api/chair", "chairs", chairCSVRows(1, 4))
+	expectStatus(t, rec, http.StatusBadRequest)
+	var report ImportReport
+	decode(t, rec, &report)
+	if report.ErrorCount != 1 || report.Errors[0].Line != 3 {
+		t.Fatalf("report = %+v", report)
+	}
+	if _, err := store.GetChair(context.Background(), 1); err != ErrNotFound {
+		t.Fatalf("chair 1 was committed despite the existing id: %v", err)
+	}
+}
+
+func TestPostChairReplacesAcrossBatches(t *testing.T) {
+	_, store, e := newBatchTestServer(t, 1)
+	expectStatus(t, uploadCSV(e, "/api/chair", "chairs", chairCSVRows(1, 3)), http.StatusCreated)
+
+	rec := uploadCSV(e, "/api/chair?mode=replace", "chairs", chairCSVRow(2, 1000, 1)+chairCSVRow(3, 2000, 1)+chairCSVRow(4, 1000, 1))
+	expectStatus(t, rec, http.StatusCreated)
+	var report ImportReport
+	decode(t, rec, &report)
+	if want := (ImportSummary{Inserted: 1, Updated: 1, Unchanged: 1, Deleted: 1}); report.Summary == nil || *report.Summary != want {
+		t.Fatalf("summary = %+v, want %+v", report.Summary, want)
+	}
+	if _, err := store.GetChair(context.Background(), 1); err != ErrNotFound {
+		t.Fatalf("chair 1 was not deleted: %v", err)
+	}
+	if chair, err := store.GetChair(context.Background(), 3); err != nil || chair.Price != 2000 {
+		t.Fatalf("chair 3 = %+v, %v", chair, err)
+	}
+}
+
+func TestPostChairRejectsTooLargeUpload(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  func(*csvImportConfig)
+	}{
+		{"row limit", func(cfg *csvImportConfig) { cfg.MaxRows = 10 }},
+		{"byte limit", func(cfg *csvImportConfig) { cfg.MaxBytes = 1000 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, store, e := newBatchTestServer(t, 2)
+			tt.cfg(&s.csvImport)
+
+			expectStatus(t, uploadCSV(e, "/api/chair", "chairs", chairCSVRows(1, 5)), http.StatusCreated)
+			expectStatus(t, uploadCSV(e, "/api/chair", "chairs", chairCSVRows(11, 30)), http.StatusRequestEntityTooLarge)
+			if _, err := store.GetChair(context.Background(), 11); err != ErrNotFound {
+				t.Fatalf("chair 11 was committed from a rejected upload: %v", err)
+			}
+		})
+	}
+}
+
+func TestInsertedEstates(t *testing.T) {
+	p := newInsertedEstates(2)
+	p.add([]Estate{{ID: 1, Rent: 300}, {ID: 2, Rent: 100}})
+	p.add([]Estate{{ID: 3, Rent: 200}, {ID: 4, Rent: 100}})
+	if len(p.lowest) != 2 || p.lowest[0].ID != 2 || p.lowest[1].ID != 4 {
+		t.Fatalf("lowest = %+v", p.lowest)
+	}
+	if len(p.shapes) != 4 || p.overflow {
+		t.Fatalf("shapes = %v, overflow = %v", len(p.shapes), p.overflow)
+	}
+
+	p.add(make([]Estate, recoInvalidateMaxEstates))
+	if !p.overflow || p.shapes != nil {
+		t.Fatalf("shapes = %v, overflow = %v after %v estates", len(p.shapes), p.overflow, recoInvalidateMaxEstates+4)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// chairCSVColumns, estateCSVColumns アップロードする CSV の列数
+const (
+	chairCSVColumns  = 13
+	estateCSVColumns = 12
+)
+
+// maxReportedErrors 取り込み結果に載せる問題のある行の上限
+const maxReportedErrors = 100
+
+// ImportRowError アップロードの一行の問題
+type ImportRowError struct {
+	Line    int      `json:"line"`
+	Reasons []string `json:"reasons"`
+}
+
+// ImportReport アップロードの取り込み結果。問題のある行は先頭から maxReportedErrors 行まで載せる
+// Summary は書き込んだ場合だけ載せる
+type ImportReport struct {
+	Mode       ImportMode       `json:"mode"`
+	DryRun     bool             `json:"dryRun"`
+	Rows       int              `json:"rows"`
+	ErrorCount int              `json:"errorCount"`
+	Errors     []ImportRowError `json:"errors"`
+	Summary    *ImportSummary   `json:"summary,omitempty"`
+}
+
+func newImportReport(mode ImportMode, dryRun bool) *ImportReport {
+	return &ImportReport{Mode: mode, DryRun: dryRun, Errors: []ImportRowError{}}
+}
+
+// add line 行目を数え、reasons があれば問題として記録する
+func (r *ImportReport) add(line int, reasons []string) {
+	r.Rows++
+	r.reject(line, reasons)
+}
+
+// reject 数え終えた line 行目に reasons があれば問題として記録する
+func (r *ImportReport) reject(line int, reasons []string) {
+	if len(reasons) == 0 {
+		return
+	}
+	r.ErrorCount++
+	if len(r.Errors) < maxReportedErrors {
+		r.Errors = append(r.Errors, ImportRowError{Line: line, Reasons: reasons})
+	}
+}
+
+// rejectExisting insert モードで既にあった ID の行を問題として記録する
+func (r *ImportReport) rejectExisting(ids idSet, err *DuplicateIDError) {
+	for _, id := range err.IDs {
+		r.reject(ids[id], []string{fmt.Sprintf("id %v already exists", id)})
+	}
+}
+
+func (r *ImportReport) failed() bool {
+	return r.ErrorCount > 0
+}
+
+// getDryRun dryRun=true なら書き込まずに検証だけする
+func getDryRun(c echo.Context) (bool, error) {
+	v := c.QueryParam("dryRun")
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// idSet 同じアップロードの中で ID が重複していないかを確かめる
+type idSet map[int64]int
+
+// check id を line 行目で使ったことを記録し、既に使われていれば理由を返す
+func (s idSet) check(id int64, line int) []string {
+	if first, ok := s[id]; ok {
+		return []string{fmt.Sprintf("duplicate id %v (first seen on line %v)", id, first)}
+	}
+	s[id] = line
+	return nil
+}
+
+func errorReasons(errs []error) []string {
+	reasons := make([]string, 0, len(errs))
+	for _, err := range errs {
+		reasons = append(reasons, err.Error())
+	}
+	return reasons
+}
+
+// parseChairRecord CSV の一行を椅子として読む。問題があれば全ての理由を返す
+func parseChairRecord(rm *RecordMapper) (Chair, []string) {
+	if len(rm.Record) != chairCSVColumns {
+		return Chair{}, []string{fmt.Sprintf("expected %v columns, got %v", chairCSVColumns, len(rm.Record))}
+	}
+	chair := Chair{
+		ID:          int64(rm.NextInt()),
+		Name:        rm.NextString(),
+		Description: rm.NextString(),
+		Thumbnail:   rm.NextString(),
+		Price:       int64(rm.NextInt()),
+		Height:      int64(rm.NextInt()),
+		Width:       int64(rm.NextInt()),
+		Depth:       int64(rm.NextInt()),
+		Color:       rm.NextString(),
+		Features:    rm.NextString(),
+		Kind:        rm.NextString(),
+		Popularity:  int64(rm.NextInt()),
+		Stock:       int64(rm.NextInt()),
+	}
+	reasons := errorReasons(rm.Errs())
+	return chair, append(reasons, validateChair(&chair)...)
+}
+
+// validateChair 椅子の値を検証し、FeaturesMask を埋める。問題があれば全ての理由を返す
+func validateChair(chair *Chair) []string {
+	reasons := make([]string, 0)
+	// 整数のカラムは全て INTEGER なので、その範囲に収まらない値は書き込めない
+	if chair.ID < math.MinInt32 || chair.ID > math.MaxInt32 {
+		reasons = append(reasons, fmt.Sprintf("id out of range: %v", chair.ID))
+	}
+	for _, v := range []struct {
+		name  string
+		value int64
+	}{
+		{"price", chair.Price},
+		{"height", chair.Height},
+		{"width", chair.Width},
+		{"depth", chair.Depth},
+		{"popularity", chair.Popularity},
+		{"stock", chair.Stock},
+	} {
+		if v.value < 0 {
+			reasons = append(reasons, fmt.Sprintf("%v must not be negative: %v", v.name, v.value))
+		}
+		if v.value > math.MaxInt32 {
+			reasons = append(reasons, fmt.Sprintf("%v out of range: %v", v.name, v.value))
+		}
+	}
+	if !containsValue(chairSearchCondition.Color.List, chair.Color) {
+		reasons = append(reasons, fmt.Sprintf("unknown color %q", chair.Color))
+	}
+	if !containsValue(chairSearchCondition.Kind.List, chair.Kind) {
+		reasons = append(reasons, fmt.Sprintf("unknown kind %q", chair.Kind))
+	}
+	featureIDs, err := chairFeatureIDs.parse(chair.Features)
+	if err != nil {
+		reasons = append(reasons, err.Error())
+	}
+	chair.FeaturesMask = featuresMask(featureIDs)
+	return reasons
+}
+
+// parseEstateRecord CSV の一行を物件として読む。問題があれば全ての理由を返す
+func parseEstateRecord(rm *RecordMapper) (Estate, []string) {
+	if len(rm.Record) != estateCSVColumns {
+		return Estate{}, []string{fmt.Sprintf("expected %v columns, got %v", estateCSVColumns, len(rm.Record))}
+	}
+	estate := Estate{
+		ID:          int64(rm.NextInt()),
+		Name:        rm.NextString(),
+		Description: rm.NextString(),
+		Thumbnail:   rm.NextString(),
+		Address:     rm.NextString(),
+		Latitude:    rm.NextFloat(),
+		Longitude:   rm.NextFloat(),
+		Rent:        int64(rm.NextInt()),
+		DoorHeight:  int64(rm.NextInt()),
+		DoorWidth:   int64(rm.NextInt()),
+		Features:    rm.NextString(),
+		Popularity:  int64(rm.NextInt()),
+	}
+	reasons := errorReasons(rm.Errs())
+	return estate, append(reasons, validateEstate(&estate)...)
+}
+
+// validateEstate 物件の値を検証し、FeaturesMask を埋める。問題があれば全ての理由を返す
+func validateEstate(estate *Estate) []string {
+	reasons := make([]string, 0)
+	// 整数のカラムは全て INTEGER なので、その範囲に収まらない値は書き込めない
+	if estate.ID < math.MinInt32 || estate.ID > math.MaxInt32 {
+		reasons = append(reasons, fmt.Sprintf("id out of range: %v", estate.ID))
+	}
+	for _, v := range []struct {
+		name  string
+		value int64
+	}{
+		{"rent", estate.Rent},
+		{"doorHeight", estate.DoorHeight},
+		{"doorWidth", estate.DoorWidth},
+		{"popularity", estate.Popularity},
+	} {
+		if v.value < 0 {
+			reasons = append(reasons, fmt.Sprintf("%v must not be negative: %v", v.name, v.value))
+		}
+		if v.value > math.MaxInt32 {
+			reasons = append(reasons, fmt.Sprintf("%v out of range: %v", v.name, v.value))
+		}
+	}
+	// NaN はどの比較も false になるので、範囲の確認とは別に弾く
+	if math.IsNaN(estate.Latitude) || estate.Latitude < -90 || estate.Latitude > 90 {
+		reasons = append(reasons, fmt.Sprintf("latitude out of range: %v", estate.Latitude))
+	}
+	if math.IsNaN(estate.Longitude) || estate.Longitude < -180 || estate.Longitude > 180 {
+		reasons = append(reasons, fmt.Sprintf("longitude out of range: %v", estate.Longitude))
+	}
+	featureIDs, err := estateFeatureIDs.parse(estate.Features)
+	if err != nil {
+		reasons = append(reasons, err.Error())
+	}
+	estate.FeaturesMask = featuresMask(featureIDs)
+	return reasons
+}
+
+func containsValue(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// importReportStatus 取り込み結果を返すときのステータスコード
+func importReportStatus(report *ImportReport) int {
+	switch {
+	case report.failed():
+		return http.StatusBadRequest
+	case report.DryRun:
+		return http.StatusOK
+	}
+	return http.StatusCreated
+}
+
+// importWriteError 取り込みを書き込めなかったときのレスポンスを返す
+// insert モードで既にある ID を使った場合はその行を載せた取り込み結果を返す
+func (s *server) importWriteError(c echo.Context, report *ImportReport, ids idSet, err error) error {
+	var derr *DuplicateIDError
+	if errors.As(err, &derr) {
+		report.rejectExisting(ids, derr)
+		return c.JSON(http.StatusBadRequest, report)
+	}
+	c.Logger().Errorf("failed to import %v rows: %v", report.Rows, err)
+	return c.NoContent(http.StatusInternalServerError)
+}
+
+// uploadReadError アップロードを最後まで読めなかったときのレスポンスを返す
+// 上限を超えた場合は 413 を、形式が違えば 415 を、CSV として読めない行があればその行を載せた取り込み結果を返す
+func (s *server) uploadReadError(c echo.Context, report *ImportReport, err error) error {
+	if errors.Is(err, errUploadTooLarge) {
+		return c.NoContent(http.StatusRequestEntityTooLarge)
+	}
+	if errors.Is(err, errUnsupportedUploadType) {
+		return c.NoContent(http.StatusUnsupportedMediaType)
+	}
+	var perr *csv.ParseError
+	if !errors.As(err, &perr) {
+		c.Logger().Errorf("failed to read upload: %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	report.add(perr.Line, []string{perr.Err.Error()})
+	return c.JSON(http.StatusBadRequest, report)
+}
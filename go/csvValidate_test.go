@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateChairIntegerRange(t *testing.T) {
+	valid := Chair{ID: 1, Price: 1000, Height: 100, Width: 70, Depth: 60, Color: "黒", Features: "肘掛け付き", Kind: "座椅子", Popularity: 1, Stock: 1}
+
+	tests := []struct {
+		name   string
+		modify func(*Chair)
+		valid  bool
+	}{
+		{"valid", func(c *Chair) {}, true},
+		{"values at max", func(c *Chair) {
+			c.ID, c.Price, c.Stock, c.Popularity = math.MaxInt32, math.MaxInt32, math.MaxInt32, math.MaxInt32
+		}, true},
+		{"id over max", func(c *Chair) { c.ID = math.MaxInt32 + 1 }, false},
+		{"id under min", func(c *Chair) { c.ID = math.MinInt32 - 1 }, false},
+		{"price over max", func(c *Chair) { c.Price = math.MaxInt32 + 1 }, false},
+		{"height over max", func(c *Chair) { c.Height = math.MaxInt64 }, false},
+		{"stock over max", func(c *Chair) { c.Stock = math.MaxInt32 + 1 }, false},
+		{"popularity over max", func(c *Chair) { c.Popularity = math.MaxInt32 + 1 }, false},
+		{"negative depth", func(c *Chair) { c.Depth = -1 }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chair := valid
+			tt.modify(&chair)
+			if reasons := validateChair(&chair); (len(reasons) == 0) != tt.valid {
+				t.Fatalf("validateChair() = %v, want valid=%v", reasons, tt.valid)
+			}
+		})
+	}
+}
+
+func TestValidateEstateRange(t *testing.T) {
+	valid := Estate{ID: 1, Latitude: 35, Longitude: 139, Rent: 40000, DoorHeight: 100, DoorWidth: 100, Features: "最上階", Popularity: 1}
+
+	tests := []struct {
+		name   string
+		modify func(*Estate)
+		valid  bool
+	}{
+		{"valid", func(e *Estate) {}, true},
+		{"coordinates at bounds", func(e *Estate) { e.Latitude, e.Longitude = -90, 180 }, true},
+		{"latitude NaN", func(e *Estate) { e.Latitude = math.NaN() }, false},
+		{"longitude NaN", func(e *Estate) { e.Longitude = math.NaN() }, false},
+		{"latitude +Inf", func(e *Estate) { e.Latitude = math.Inf(1) }, false},
+		{"longitude -Inf", func(e *Estate) { e.Longitude = math.Inf(-1) }, false},
+		{"latitude out of range", func(e *Estate) { e.Latitude = 90.5 }, false},
+		{"id over max", func(e *Estate) { e.ID = math.MaxInt32 + 1 }, false},
+		{"rent over max", func(e *Estate) { e.Rent = math.MaxInt32 + 1 }, false},
+		{"door width over max", func(e *Estate) { e.DoorWidth = math.MaxInt64 }, false},
+		{"popularity over max", func(e *Estate) { e.Popularity = math.MaxInt32 + 1 }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			estate := valid
+			tt.modify(&estate)
+			if reasons := validateEstate(&estate); (len(reasons) == 0) != tt.valid {
+				t.Fatalf("validateEstate() = %v, want valid=%v", reasons, tt.valid)
+			}
+		})
+	}
+}
+
+func TestPostEstateRejectsNonFiniteCoordinates(t *testing.T) {
+	_, e := newTestServer(t)
+	// strconv.ParseFloat は NaN と Inf を読めてしまう
+	rows := strings.Replace(estateCSVRow(1, 40000, 100, 100, 35, 139), "35,139", "NaN,139", 1) +
+		strings.Replace(estateCSVRow(2, 40000, 100, 100, 35, 139), "35,139", "35,+Inf", 1) +
+		estateCSVRow(3, 2147483648, 100, 100, 35, 139)
+	rec := uploadCSV(e, "/api/estate", "estates", rows)
+	expectStatus(t, rec, http.StatusBadRequest)
+	var report ImportReport
+	decode(t, rec, &report)
+	if report.ErrorCount != 3 {
+		t.Fatalf("report = %+v", report)
+	}
+}
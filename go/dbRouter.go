@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// replicaHealthCheckInterval リードレプリカの死活を確認する間隔
+const replicaHealthCheckInterval = 2 * time.Second
+
+type replica struct {
+	db      *sqlx.DB
+	name    string
+	healthy int32
+}
+
+// dbRouter 書き込みをプライマリに、読み込みを正常なリードレプリカに振り分ける
+// 正常なレプリカがない場合や、同じリクエスト内で書き込みをした後の読み込みはプライマリに送る
+type dbRouter struct {
+	primary  *sqlx.DB
+	replicas []*replica
+	next     uint32
+}
+
+func newDBRouter(primary *sqlx.DB) *dbRouter {
+	return &dbRouter{primary: primary}
+}
+
+func (r *dbRouter) addReplica(name string, db *sqlx.DB) {
+	r.replicas = append(r.replicas, &replica{db: db, name: name})
+}
+
+// connectReplicas envs のリードレプリカを r に加える
+func connectReplicas(r *dbRouter, envs []*MySQLConnectionEnv) error {
+	for _, env := range envs {
+		db, err := env.ConnectDB()
+		if err != nil {
+			return fmt.Errorf("failed to connect replica %v:%v: %w", env.Host, env.Port, err)
+		}
+		db.SetMaxOpenConns(32)
+		db.SetMaxIdleConns(32)
+		r.addReplica(env.Host+":"+env.Port, db)
+	}
+	return nil
+}
+
+// reader 読み込みに使うコネクションプールを返す
+func (r *dbRouter) reader(ctx context.Context) *sqlx.DB {
+	if len(r.replicas) == 0 || hasWritten(ctx) || ctx.Value(primaryReadKey{}) != nil {
+		return r.primary
+	}
+	start := atomic.AddUint32(&r.next, 1)
+	for i := range r.replicas {
+		rep := r.replicas[(int(start)+i)%len(r.replicas)]
+		if atomic.LoadInt32(&rep.healthy) == 1 {
+			return rep.db
+		}
+	}
+	return r.primary
+}
+
+// writer 書き込みに使うコネクションプールを返し、以降の同じリクエスト内の読み込みをプライマリに向ける
+func (r *dbRouter) writer(ctx context.Context) *sqlx.DB {
+	markWritten(ctx)
+	return r.primary
+}
+
+// checkReplicas 全てのレプリカに ping して死活を更新する
+func (r *dbRouter) checkReplicas(ctx context.Context, logger echo.Logger) {
+	for _, rep := range r.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, time.Second)
+		err := rep.db.PingContext(pingCtx)
+		cancel()
+
+		healthy := int32(1)
+		if err != nil {
+			healthy = 0
+		}
+		if atomic.SwapInt32(&rep.healthy, healthy) != healthy {
+			if err != nil {
+				logger.Warnf("replica %v is unhealthy, falling back : %v", rep.name, err)
+			} else {
+				logger.Infof("replica %v is healthy", rep.name)
+			}
+		}
+	}
+}
+
+// runHealthCheck ctx が終わるまで定期的にレプリカの死活を確認する
+func (r *dbRouter) runHealthCheck(ctx context.Context, logger echo.Logger) {
+	if len(r.replicas) == 0 {
+		return
+	}
+	r.checkReplicas(ctx, logger)
+	ticker := time.NewTicker(replicaHealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.checkReplicas(ctx, logger)
+		}
+	}
+}
+
+// Close プライマリと全てのレプリカのコネクションプールを閉じる
+func (r *dbRouter) Close() error {
+	for _, rep := range r.replicas {
+		rep.db.Close()
+	}
+	return r.primary.Close()
+}
+
+type writtenKey struct{}
+
+type primaryReadKey struct{}
+
+// withPrimaryReads ctx での読み込みをプライマリに向ける。書き込みの直後にレプリカの遅れた結果をキャッシュしないために使う
+func withPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadKey{}, true)
+}
+
+// trackWrites リクエストの中で書き込みがあったかを記録できるようにするミドルウェア
+func trackWrites(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		c.SetRequest(req.WithContext(context.WithValue(req.Context(), writtenKey{}, new(int32))))
+		return next(c)
+	}
+}
+
+func markWritten(ctx context.Context) {
+	if written, ok := ctx.Value(writtenKey{}).(*int32); ok {
+		atomic.StoreInt32(written, 1)
+	}
+}
+
+func hasWritten(ctx context.Context) bool {
+	written, ok := ctx.Value(writtenKey{}).(*int32)
+	return ok && atomic.LoadInt32(written) == 1
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// unconnectedDB 接続はしないコネクションプール。振り分け先の確認だけに使う
+func unconnectedDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Open("mysql", "isucon:isucon@tcp(127.0.0.1:1)/isuumo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestDBRouterReader(t *testing.T) {
+	primary, replica := unconnectedDB(t), unconnectedDB(t)
+	r := newDBRouter(primary)
+	r.addReplica("replica", replica)
+
+	if got := r.reader(context.Background()); got != primary {
+		t.Fatal("read from an unhealthy replica")
+	}
+	r.replicas[0].healthy = 1
+	if got := r.reader(context.Background()); got != replica {
+		t.Fatal("did not read from the healthy replica")
+	}
+	if got := r.reader(withPrimaryReads(context.Background())); got != primary {
+		t.Fatal("withPrimaryReads read from the replica")
+	}
+
+	ctx := context.WithValue(context.Background(), writtenKey{}, new(int32))
+	if got := r.reader(ctx); got != replica {
+		t.Fatal("read from the primary before writing")
+	}
+	r.writer(ctx)
+	if got := r.reader(ctx); got != primary {
+		t.Fatal("read from the replica after writing in the same request")
+	}
+}
+
+func TestCachesRefillFromPrimaryAfterInvalidation(t *testing.T) {
+	low := newLowPricedEstateCache(Limit)
+	reco := newRecoCache(recoCacheSize, Limit)
+	if low.refillFromPrimary() || reco.refillFromPrimary() {
+		t.Fatal("cold caches refill from the primary")
+	}
+
+	low.clear()
+	reco.clear()
+	if !low.refillFromPrimary() || !reco.refillFromPrimary() {
+		t.Fatal("cleared caches refill from a replica")
+	}
+
+	low, reco = newLowPricedEstateCache(Limit), newRecoCache(recoCacheSize, Limit)
+	low.merge([]Estate{{ID: 1}})
+	reco.invalidate([]Estate{{ID: 1}})
+	if !low.refillFromPrimary() || !reco.refillFromPrimary() {
+		t.Fatal("caches refill from a replica right after an insert")
+	}
+}
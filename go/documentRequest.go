@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 資料請求の状態。pending, sent, closed の順にだけ進む
+const (
+	DocumentRequestPending = "pending"
+	DocumentRequestSent    = "sent"
+	DocumentRequestClosed  = "closed"
+)
+
+// nextDocumentRequestStatus 各状態から進められる次の状態
+var nextDocumentRequestStatus = map[string]string{
+	DocumentRequestPending: DocumentRequestSent,
+	DocumentRequestSent:    DocumentRequestClosed,
+}
+
+// defaultDocumentRequestInterval 同じメールアドレスから同じ物件へ続けて資料請求できるまでの時間の既定値
+const defaultDocumentRequestInterval = time.Hour
+
+// DocumentRequest 物件の資料請求
+type DocumentRequest struct {
+	ID        int64     `db:"id" json:"id"`
+	EstateID  int64     `db:"estate_id" json:"estateId"`
+	Email     string    `db:"email" json:"email"`
+	Status    string    `db:"status" json:"status"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+	UpdatedAt time.Time `db:"updated_at" json:"updatedAt"`
+}
+
+type DocumentRequestListResponse struct {
+	Count    int64             `json:"count"`
+	Requests []DocumentRequest `json:"requests"`
+}
+
+// DocumentRequestQuery 資料請求の一覧の条件。空の条件は絞り込みに使わない
+type DocumentRequestQuery struct {
+	EstateID int64
+	Email    string
+	Status   string
+	Page     int
+	PerPage  int
+}
+
+func (q DocumentRequestQuery) match(r *DocumentRequest) bool {
+	return (q.EstateID == 0 || r.EstateID == q.EstateID) &&
+		(q.Email == "" || r.Email == q.Email) &&
+		(q.Status == "" || r.Status == q.Status)
+}
+
+func validDocumentRequestStatus(status string) bool {
+	return status == DocumentRequestPending || status == DocumentRequestSent || status == DocumentRequestClosed
+}
+
+// canTransition 資料請求の状態を from から to に進められるかを判定する
+func canTransition(from, to string) bool {
+	return nextDocumentRequestStatus[from] == to
+}
+
+// loadDocumentRequestInterval DOCUMENT_REQUEST_INTERVAL 環境変数 (1h などの time.Duration 形式) から資料請求の間隔を決める。0 なら制限しない
+func loadDocumentRequestInterval() (time.Duration, error) {
+	v := getEnv("DOCUMENT_REQUEST_INTERVAL", "")
+	if v == "" {
+		return defaultDocumentRequestInterval, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid DOCUMENT_REQUEST_INTERVAL %q", v)
+	}
+	return d, nil
+}
+
+func (s *server) getDocumentRequests(c echo.Context) error {
+	q := DocumentRequestQuery{
+		Email:  c.QueryParam("email"),
+		Status: c.QueryParam("status"),
+	}
+	if q.Status != "" && !validDocumentRequestStatus(q.Status) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: fmt.Sprintf("unknown status %q", q.Status)})
+	}
+	if v := c.QueryParam("estateId"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return c.NoContent(http.StatusBadRequest)
+		}
+		q.EstateID = id
+	}
+	var ok bool
+	q.Page, q.PerPage, ok = getPagination(c)
+	if !ok {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	var res DocumentRequestListResponse
+	var err error
+	res.Count, res.Requests, err = s.estates.DocumentRequests(c.Request().Context(), q)
+	if err != nil {
+		c.Logger().Errorf("getDocumentRequests DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (s *server) updateDocumentRequestStatus(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.NoContent(http.StatusBadRequest)
+	}
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if !validDocumentRequestStatus(body.Status) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: fmt.Sprintf("unknown status %q", body.Status)})
+	}
+
+	req, err := s.estates.UpdateDocumentRequestStatus(c.Request().Context(), int64(id), body.Status)
+	if err != nil {
+		switch err {
+		case ErrNotFound:
+			return c.NoContent(http.StatusNotFound)
+		case ErrInvalidStatusTransition:
+			return c.JSON(http.StatusConflict, ErrorResponse{Message: err.Error()})
+		}
+		c.Logger().Errorf("updateDocumentRequestStatus DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, req)
+}
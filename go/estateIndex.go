@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/isucon/isucon10-qualify/isuumo/spatial"
+	"github.com/labstack/echo"
+)
+
+// estateIndexCellSize 物件インデックスのグリッドの一辺 (度)
+const estateIndexCellSize = 0.05
+
+type estateLocation struct {
+	ID         int64   `db:"id"`
+	Latitude   float64 `db:"latitude"`
+	Longitude  float64 `db:"longitude"`
+	Popularity int64   `db:"popularity"`
+}
+
+func (l estateLocation) item() spatial.Item {
+	return spatial.Item{
+		ID:         l.ID,
+		Point:      spatial.Point{Latitude: l.Latitude, Longitude: l.Longitude},
+		Popularity: l.Popularity,
+	}
+}
+
+func (e *Estate) indexItem() spatial.Item {
+	return estateLocation{ID: e.ID, Latitude: e.Latitude, Longitude: e.Longitude, Popularity: e.Popularity}.item()
+}
+
+func (s *mysqlEstateStore) selectLocations(ctx context.Context) ([]estateLocation, error) {
+	locations := []estateLocation{}
+	err := s.db.primary.SelectContext(ctx, &locations, "SELECT id, latitude, longitude, popularity FROM estate")
+	return locations, err
+}
+
+// loadIndex estate テーブルから物件インデックスを作り直す
+func (s *mysqlEstateStore) loadIndex(ctx context.Context) error {
+	locations, err := s.selectLocations(ctx)
+	if err != nil {
+		return err
+	}
+	items := make([]spatial.Item, 0, len(locations))
+	for _, l := range locations {
+		items = append(items, l.item())
+	}
+	s.index.Reset(items)
+	return nil
+}
+
+// EstateIndexCheckResponse 物件インデックスと estate テーブルの突き合わせ結果
+type EstateIndexCheckResponse struct {
+	Indexed    int     `json:"indexed"`
+	Stored     int     `json:"stored"`
+	Missing    []int64 `json:"missing"`
+	Unexpected []int64 `json:"unexpected"`
+	Mismatched []int64 `json:"mismatched"`
+}
+
+// checkIndex 物件インデックスが estate テーブルと一致しているかを確認する
+func (s *mysqlEstateStore) checkIndex(ctx context.Context) (*EstateIndexCheckResponse, error) {
+	locations, err := s.selectLocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return compareIndex(s.index, locations), nil
+}
+
+// compareIndex index を estate テーブルの locations と突き合わせる
+func compareIndex(index *spatial.Index, locations []estateLocation) *EstateIndexCheckResponse {
+	res := &EstateIndexCheckResponse{
+		Indexed:    index.Len(),
+		Stored:     len(locations),
+		Missing:    []int64{},
+		Unexpected: []int64{},
+		Mismatched: []int64{},
+	}
+	stored := make(map[int64]struct{}, len(locations))
+	for _, l := range locations {
+		stored[l.ID] = struct{}{}
+		item, ok := index.Get(l.ID)
+		if !ok {
+			res.Missing = append(res.Missing, l.ID)
+		} else if item != l.item() {
+			res.Mismatched = append(res.Mismatched, l.ID)
+		}
+	}
+	for _, id := range index.IDs() {
+		if _, ok := stored[id]; !ok {
+			res.Unexpected = append(res.Unexpected, id)
+		}
+	}
+	sort.Slice(res.Unexpected, func(i, j int) bool { return res.Unexpected[i] < res.Unexpected[j] })
+	return res
+}
+
+func (s *server) checkEstateIndex(c echo.Context) error {
+	store, ok := s.estates.(*mysqlEstateStore)
+	if !ok {
+		return c.NoContent(http.StatusNotFound)
+	}
+	res, err := store.checkIndex(c.Request().Context())
+	if err != nil {
+		c.Logger().Errorf("checkEstateIndex DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, res)
+}
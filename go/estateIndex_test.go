@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/isucon/isucon10-qualify/isuumo/spatial"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestCompareIndex(t *testing.T) {
+	index := spatial.New(estateIndexCellSize)
+	index.Reset([]spatial.Item{
+		estateLocation{ID: 1, Latitude: 35.1, Longitude: 139.1, Popularity: 10}.item(),
+		estateLocation{ID: 2, Latitude: 35.2, Longitude: 139.2, Popularity: 20}.item(),
+		estateLocation{ID: 3, Latitude: 35.3, Longitude: 139.3, Popularity: 30}.item(),
+		estateLocation{ID: 9, Latitude: 35.9, Longitude: 139.9, Popularity: 90}.item(),
+		estateLocation{ID: 7, Latitude: 35.7, Longitude: 139.7, Popularity: 70}.item(),
+	})
+	locations := []estateLocation{
+		{ID: 1, Latitude: 35.1, Longitude: 139.1, Popularity: 10},
+		// 位置と人気度のどちらが違っても不一致になる
+		{ID: 2, Latitude: 35.25, Longitude: 139.2, Popularity: 20},
+		{ID: 3, Latitude: 35.3, Longitude: 139.3, Popularity: 31},
+		{ID: 5, Latitude: 35.5, Longitude: 139.5, Popularity: 50},
+		{ID: 4, Latitude: 35.4, Longitude: 139.4, Popularity: 40},
+	}
+
+	got := compareIndex(index, locations)
+	want := &EstateIndexCheckResponse{
+		Indexed:    5,
+		Stored:     5,
+		Missing:    []int64{5, 4},
+		Unexpected: []int64{7, 9},
+		Mismatched: []int64{2, 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("compareIndex = %+v, want %+v", got, want)
+	}
+
+	index.Reset(nil)
+	got = compareIndex(index, nil)
+	want = &EstateIndexCheckResponse{Missing: []int64{}, Unexpected: []int64{}, Mismatched: []int64{}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("compareIndex of empty index = %+v, want %+v", got, want)
+	}
+}
+
+// benchmarkEstateStore ベンチマークに使う MySQL の物件の保存先を返す
+// MYSQL_HOST か MYSQL_ESTATE_HOST か ISUUMO_CONFIG で接続先を指定しなければスキップする
+func benchmarkEstateStore(b *testing.B) *mysqlEstateStore {
+	b.Helper()
+	if os.Getenv("MYSQL_HOST") == "" && os.Getenv("MYSQL_ESTATE_HOST") == "" && os.Getenv("ISUUMO_CONFIG") == "" {
+		b.Skip("no database configured")
+	}
+	cfg, err := LoadDBConfig()
+	if err != nil {
+		b.Fatal(err)
+	}
+	db, err := cfg.Estate.ConnectDB()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		b.Skipf("database is not reachable: %v", err)
+	}
+	return &mysqlEstateStore{db: newDBRouter(db), index: spatial.New(estateIndexCellSize)}
+}
+
+// benchmarkPolygons 保存された物件の周りに、なぞって検索するような多角形を作る
+func benchmarkPolygons(locations []estateLocation) []spatial.Polygon {
+	r := rand.New(rand.NewSource(3))
+	polygons := make([]spatial.Polygon, 0, 100)
+	for i := 0; i < 100; i++ {
+		center := locations[r.Intn(len(locations))]
+		size := 0.01 + r.Float64()*0.1
+		polygons = append(polygons, spatial.Polygon{
+			{Latitude: center.Latitude - size, Longitude: center.Longitude},
+			{Latitude: center.Latitude, Longitude: center.Longitude + size},
+			{Latitude: center.Latitude + size, Longitude: center.Longitude},
+			{Latitude: center.Latitude, Longitude: center.Longitude - size},
+			{Latitude: center.Latitude - size, Longitude: center.Longitude},
+		})
+	}
+	return polygons
+}
+
+// BenchmarkSearchEstatesInPolygon 物件インデックスでの検索と、以前の外接矩形で絞り込む SQL からの検索を比べる
+func BenchmarkSearchEstatesInPolygon(b *testing.B) {
+	store := benchmarkEstateStore(b)
+	ctx := context.Background()
+	locations, err := store.selectLocations(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if len(locations) == 0 {
+		b.Skip("no estates stored")
+	}
+	if err := store.loadIndex(ctx); err != nil {
+		b.Fatal(err)
+	}
+	polygons := benchmarkPolygons(locations)
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := store.SearchEstatesInPolygon(ctx, polygons[i%len(polygons)], NazotteLimit); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("bounding box query", func(b *testing.B) {
+		query := `SELECT id, latitude, longitude FROM estate WHERE latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ? ORDER BY popularity DESC, id ASC`
+		for i := 0; i < b.N; i++ {
+			polygon := polygons[i%len(polygons)]
+			bounds := polygon.Bounds()
+			candidates := []Estate{}
+			err := store.db.primary.SelectContext(ctx, &candidates, query, bounds.Min.Latitude, bounds.Max.Latitude, bounds.Min.Longitude, bounds.Max.Longitude)
+			if err != nil {
+				b.Fatal(err)
+			}
+			found := make([]int64, 0, NazotteLimit)
+			for _, estate := range candidates {
+				if polygon.Contains(spatial.Point{Latitude: estate.Latitude, Longitude: estate.Longitude}) {
+					found = append(found, estate.ID)
+					if len(found) == NazotteLimit {
+						break
+					}
+				}
+			}
+			if len(found) == 0 {
+				continue
+			}
+			estates := []Estate{}
+			q, params, err := sqlx.In(`SELECT `+estateColumns+` FROM estate WHERE id IN (?)`, found)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := store.db.primary.SelectContext(ctx, &estates, store.db.primary.Rebind(q), params...); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// exportFlushRows 書き出しでこの行数ごとにレスポンスを送る
+const exportFlushRows = 1000
+
+// invalidFilterError 検索条件の誤りのうち、理由をレスポンスに載せるもの
+type invalidFilterError struct {
+	err error
+}
+
+func (e *invalidFilterError) Error() string {
+	return e.err.Error()
+}
+
+// searchQueryError 検索条件を読めなかったときのレスポンスを返す
+func searchQueryError(c echo.Context, err error) error {
+	var ferr *invalidFilterError
+	if errors.As(err, &ferr) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: ferr.Error()})
+	}
+	return c.NoContent(http.StatusBadRequest)
+}
+
+// chairRecord 椅子を parseChairRecord で読める CSV の一行にする
+func chairRecord(chair Chair) []string {
+	return []string{
+		strconv.FormatInt(chair.ID, 10),
+		chair.Name,
+		chair.Description,
+		chair.Thumbnail,
+		strconv.FormatInt(chair.Price, 10),
+		strconv.FormatInt(chair.Height, 10),
+		strconv.FormatInt(chair.Width, 10),
+		strconv.FormatInt(chair.Depth, 10),
+		chair.Color,
+		chair.Features,
+		chair.Kind,
+		strconv.FormatInt(chair.Popularity, 10),
+		strconv.FormatInt(chair.Stock, 10),
+	}
+}
+
+// estateRecord 物件を parseEstateRecord で読める CSV の一行にする
+// 緯度経度は読み直したときに同じ値になる最短の表記にする
+func estateRecord(estate Estate) []string {
+	return []string{
+		strconv.FormatInt(estate.ID, 10),
+		estate.Name,
+		estate.Description,
+		estate.Thumbnail,
+		estate.Address,
+		strconv.FormatFloat(estate.Latitude, 'f', -1, 64),
+		strconv.FormatFloat(estate.Longitude, 'f', -1, 64),
+		strconv.FormatInt(estate.Rent, 10),
+		strconv.FormatInt(estate.DoorHeight, 10),
+		strconv.FormatInt(estate.DoorWidth, 10),
+		estate.Features,
+		strconv.FormatInt(estate.Popularity, 10),
+	}
+}
+
+// csvExport レスポンスに CSV を書き出す
+// 最初の行を書くまでヘッダを送らないので、読み出しの前に失敗すればエラーのレスポンスを返せる
+type csvExport struct {
+	res      *echo.Response
+	filename string
+	w        *csv.Writer
+	rows     int
+}
+
+func newCSVExport(c echo.Context, filename string) *csvExport {
+	return &csvExport{res: c.Response(), filename: filename}
+}
+
+func (e *csvExport) start() {
+	e.res.Header().Set(echo.HeaderContentType, "text/csv; charset=UTF-8")
+	e.res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", e.filename))
+	e.res.WriteHeader(http.StatusOK)
+	e.w = csv.NewWriter(e.res)
+}
+
+func (e *csvExport) write(record []string) error {
+	if e.w == nil {
+		e.start()
+	}
+	if err := e.w.Write(record); err != nil {
+		return err
+	}
+	e.rows++
+	if e.rows%exportFlushRows == 0 {
+		e.w.Flush()
+		if err := e.w.Error(); err != nil {
+			return err
+		}
+		e.res.Flush()
+	}
+	return nil
+}
+
+// finish 書き出しを終える。途中で失敗した場合、ヘッダを送った後ならステータスを変えられないのでログに残すだけにする
+func (e *csvExport) finish(c echo.Context, err error) error {
+	if err == nil {
+		if e.w == nil {
+			e.start()
+		}
+		e.w.Flush()
+		err = e.w.Error()
+	}
+	if err == nil {
+		return nil
+	}
+	if e.w == nil {
+		c.Logger().Errorf("failed to export %v: %v", e.filename, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	c.Logger().Errorf("export of %v aborted after %v rows: %v", e.filename, e.rows, err)
+	return nil
+}
+
+func (s *server) exportChairs(c echo.Context) error {
+	q, err := parseChairSearchQuery(c)
+	if err != nil {
+		return searchQueryError(c, err)
+	}
+	export := newCSVExport(c, "chairs.csv")
+	err = s.chairs.ExportChairs(c.Request().Context(), q, func(chair Chair) error {
+		return export.write(chairRecord(chair))
+	})
+	return export.finish(c, err)
+}
+
+func (s *server) exportEstates(c echo.Context) error {
+	q, err := parseEstateSearchQuery(c)
+	if err != nil {
+		return searchQueryError(c, err)
+	}
+	export := newCSVExport(c, "estates.csv")
+	err = s.estates.ExportEstates(c.Request().Context(), q, func(estate Estate) error {
+		return export.write(estateRecord(estate))
+	})
+	return export.finish(c, err)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// csvText records を CSV にする。カンマや引用符、改行を含むフィールドは引用される
+func csvText(t *testing.T, records [][]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.WriteAll(records); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func readExport(t *testing.T, body string) [][]string {
+	t.Helper()
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV %q: %v", body, err)
+	}
+	return records
+}
+
+func exportedIDs(records [][]string) []string {
+	ids := make([]string, 0, len(records))
+	for _, record := range records {
+		ids = append(ids, record[0])
+	}
+	return ids
+}
+
+func TestExportChairsRoundTrip(t *testing.T) {
+	s, e := newTestServer(t)
+
+	chairs := [][]string{
+		{"1", "椅子, \"特製\"", "一行目\n二行目", "/images/chair/1.png", "2000", "100", "70", "60", "黒", "肘掛け付き", "座椅子", "10", "3"},
+		{"2", "普通の椅子", "説明に \"引用符\" と, カンマ", "/images/chair/2.png", "5000", "100", "70", "60", "黒", "", "座椅子", "20", "1"},
+		{"3", "椅子3", "説明\r\n改行", "/images/chair/3.png", "2500", "100", "70", "60", "黒", "肘掛け付き", "座椅子", "30", "5"},
+	}
+	expectStatus(t, uploadCSV(e, "/api/chair", "chairs", csvText(t, chairs)), http.StatusCreated)
+
+	rec := doRequest(e, http.MethodGet, "/api/chair/export", nil, "")
+	expectStatus(t, rec, http.StatusOK)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	exported := rec.Body.String()
+	if got := exportedIDs(readExport(t, exported)); !reflect.DeepEqual(got, []string{"1", "2", "3"}) {
+		t.Fatalf("exported ids = %v", got)
+	}
+
+	rec = doRequest(e, http.MethodGet, "/api/chair/export?priceRangeId=0", nil, "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := exportedIDs(readExport(t, rec.Body.String())); !reflect.DeepEqual(got, []string{"1", "3"}) {
+		t.Fatalf("filtered export ids = %v, want [1 3]", got)
+	}
+
+	// 書き出した CSV を別のストアに取り込み直すと同じ椅子になる
+	fresh, freshEcho := newTestServer(t)
+	expectStatus(t, uploadCSV(freshEcho, "/api/chair", "chairs", exported), http.StatusCreated)
+	want := s.chairs.(*memoryChairStore).chairs
+	got := fresh.chairs.(*memoryChairStore).chairs
+	if !reflect.DeepEqual(got, want) {
+		for id := range want {
+			if !reflect.DeepEqual(got[id], want[id]) {
+				t.Errorf("chair %v = %+v, want %+v", id, got[id], want[id])
+			}
+		}
+		t.Fatalf("re-imported %v chairs, want %v", len(got), len(want))
+	}
+
+	rec = doRequest(freshEcho, http.MethodGet, "/api/chair/export", nil, "")
+	if rec.Body.String() != exported {
+		t.Fatalf("second export differs:\n%s\nwant:\n%s", rec.Body.String(), exported)
+	}
+}
+
+func TestExportEstatesRoundTrip(t *testing.T) {
+	s, e := newTestServer(t)
+
+	estates := [][]string{
+		{"1", "物件, \"一\"", "一行目\n二行目", "/images/estate/1.png", "東京都千代田区, 丸の内", "35.6812362", "139.7671248", "40000", "100", "100", "最上階", "10"},
+		{"2", "物件2", "説明", "/images/estate/2.png", "東京都", "0.30000000000000004", "-0.0000001", "120000", "100", "100", "", "20"},
+		{"3", "物件3", "\"引用符\"だけ", "/images/estate/3.png", "東京都", "-33.8688", "151.2093", "45000", "100", "100", "最上階", "30"},
+	}
+	expectStatus(t, uploadCSV(e, "/api/estate", "estates", csvText(t, estates)), http.StatusCreated)
+
+	rec := doRequest(e, http.MethodGet, "/api/estate/export", nil, "")
+	expectStatus(t, rec, http.StatusOK)
+	exported := rec.Body.String()
+	records := readExport(t, exported)
+	if got := exportedIDs(records); !reflect.DeepEqual(got, []string{"1", "2", "3"}) {
+		t.Fatalf("exported ids = %v", got)
+	}
+	// 緯度経度は指数表記にせず、読み直して同じ値になる最短の表記で書き出す
+	for i, record := range records {
+		if record[5] != estates[i][5] || record[6] != estates[i][6] {
+			t.Errorf("estate %v coordinates = %v,%v, want %v,%v", record[0], record[5], record[6], estates[i][5], estates[i][6])
+		}
+	}
+
+	rec = doRequest(e, http.MethodGet, "/api/estate/export?rentRangeId=0", nil, "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := exportedIDs(readExport(t, rec.Body.String())); !reflect.DeepEqual(got, []string{"1", "3"}) {
+		t.Fatalf("filtered export ids = %v, want [1 3]", got)
+	}
+
+	fresh, freshEcho := newTestServer(t)
+	expectStatus(t, uploadCSV(freshEcho, "/api/estate", "estates", exported), http.StatusCreated)
+	want := s.estates.(*memoryEstateStore).estates
+	got := fresh.estates.(*memoryEstateStore).estates
+	if !reflect.DeepEqual(got, want) {
+		for id := range want {
+			if !reflect.DeepEqual(got[id], want[id]) {
+				t.Errorf("estate %v = %+v, want %+v", id, got[id], want[id])
+			}
+		}
+		t.Fatalf("re-imported %v estates, want %v", len(got), len(want))
+	}
+
+	rec = doRequest(freshEcho, http.MethodGet, "/api/estate/export", nil, "")
+	if rec.Body.String() != exported {
+		t.Fatalf("second export differs:\n%s\nwant:\n%s", rec.Body.String(), exported)
+	}
+}
+
+func TestExportRejectsInvalidFilter(t *testing.T) {
+	_, e := newTestServer(t)
+	expectStatus(t, doRequest(e, http.MethodGet, "/api/chair/export?priceRangeId=99", nil, ""), http.StatusBadRequest)
+	expectStatus(t, doRequest(e, http.MethodGet, "/api/estate/export?rentRangeId=x", nil, ""), http.StatusBadRequest)
+}
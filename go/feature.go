@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// featureIDs 特徴名から features_mask のビットの位置 (feature_id) を引く表
+// feature_id は検索条件の feature.list の添字で、4_FeatureTags.sql と揃えている
+type featureIDs map[string]int
+
+var chairFeatureIDs featureIDs
+var estateFeatureIDs featureIDs
+
+func newFeatureIDs(cond ListCondition) (featureIDs, error) {
+	if len(cond.List) > 64 {
+		return nil, fmt.Errorf("too many features to fit in features_mask: %v", len(cond.List))
+	}
+	ids := make(featureIDs, len(cond.List))
+	for i, name := range cond.List {
+		ids[name] = i
+	}
+	return ids, nil
+}
+
+// parse CSV の特徴名を feature_id に変換する。未知の特徴名はエラーにする
+func (f featureIDs) parse(features string) ([]int, error) {
+	if features == "" {
+		return []int{}, nil
+	}
+	return f.lookup(strings.Split(features, ","))
+}
+
+// lookup 特徴名を重複を除いて feature_id に変換する。未知の特徴名はエラーにする
+func (f featureIDs) lookup(features []string) ([]int, error) {
+	ids := make([]int, 0, len(features))
+	seen := map[int]bool{}
+	for _, name := range features {
+		id, ok := f[name]
+		if !ok {
+			return nil, fmt.Errorf("Unexpected feature %q", name)
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// featuresMask feature_id 番目のビットを立てた features_mask の値を返す
+func featuresMask(ids []int) uint64 {
+	var mask uint64
+	for _, id := range ids {
+		mask |= 1 << uint(id)
+	}
+	return mask
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+const (
+	// dbConnectAttempts 起動時にデータベースへの接続を試みる回数
+	dbConnectAttempts       = 10
+	dbConnectInitialBackoff = 200 * time.Millisecond
+	dbConnectMaxBackoff     = 5 * time.Second
+
+	readinessTimeout = 2 * time.Second
+)
+
+// expectedChairColumns, expectedEstateColumns 各データベースにあるべきテーブルと、初期化スクリプトで追加する列
+var (
+	expectedChairColumns = map[string][]string{
+		"chair":             {"price_range", "height_range", "width_range", "depth_range", "features_mask"},
+		"orders":            {"id", "chair_id", "email", "price", "quantity", "created_at"},
+		"chair_reservation": {"token", "chair_id", "expires_at"},
+	}
+	expectedEstateColumns = map[string][]string{
+		"estate":           {"rent_range", "door_height_range", "door_width_range", "features_mask"},
+		"document_request": {"id", "estate_id", "email", "status", "created_at", "updated_at"},
+	}
+)
+
+// openDB 実際に ping が通るまで間隔を伸ばしながら接続を試みる。dbConnectAttempts 回失敗したらエラーを返す
+// sqlx.Open は接続しないので、ping しないと接続できたかわからない
+func openDB(name string, mc *MySQLConnectionEnv, logger echo.Logger) (*sqlx.DB, error) {
+	db, err := mc.ConnectDB()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v database config: %w", name, err)
+	}
+
+	backoff := dbConnectInitialBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), dbConnectMaxBackoff)
+		err = db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return db, nil
+		}
+		if attempt == dbConnectAttempts {
+			break
+		}
+		logger.Warnf("%v database %v:%v is not reachable (attempt %v/%v), retrying in %v : %v", name, mc.Host, mc.Port, attempt, dbConnectAttempts, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > dbConnectMaxBackoff {
+			backoff = dbConnectMaxBackoff
+		}
+	}
+	db.Close()
+	return nil, fmt.Errorf("failed to connect to %v database %v:%v after %v attempts: %w", name, mc.Host, mc.Port, dbConnectAttempts, err)
+}
+
+// ReadinessResponse /readyz のレスポンス。Checks には確認項目ごとに ok かエラーの内容が入る
+type ReadinessResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+func healthz(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
+}
+
+func (s *server) readyz(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]error{
+		"searchCondition": checkSearchConditions(),
+		"chairDB":         checkDatabase(ctx, s.chairDB.primary, expectedChairColumns),
+		"estateDB":        checkDatabase(ctx, s.estateDB.primary, expectedEstateColumns),
+	}
+	res := ReadinessResponse{Ready: true, Checks: make(map[string]string, len(checks))}
+	for name, err := range checks {
+		if err != nil {
+			res.Ready = false
+			res.Checks[name] = err.Error()
+		} else {
+			res.Checks[name] = "ok"
+		}
+	}
+	if !res.Ready {
+		return c.JSON(http.StatusServiceUnavailable, res)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// checkSearchConditions 検索条件のフィクスチャが読み込まれているかを確認する
+func checkSearchConditions() error {
+	ranges := map[string][]*Range{
+		"chair.width":       chairSearchCondition.Width.Ranges,
+		"chair.height":      chairSearchCondition.Height.Ranges,
+		"chair.depth":       chairSearchCondition.Depth.Ranges,
+		"chair.price":       chairSearchCondition.Price.Ranges,
+		"estate.doorWidth":  estateSearchCondition.DoorWidth.Ranges,
+		"estate.doorHeight": estateSearchCondition.DoorHeight.Ranges,
+		"estate.rent":       estateSearchCondition.Rent.Ranges,
+	}
+	lists := map[string][]string{
+		"chair.color":    chairSearchCondition.Color.List,
+		"chair.kind":     chairSearchCondition.Kind.List,
+		"chair.feature":  chairSearchCondition.Feature.List,
+		"estate.feature": estateSearchCondition.Feature.List,
+	}
+
+	empty := make([]string, 0)
+	for name, r := range ranges {
+		if len(r) == 0 {
+			empty = append(empty, name)
+		}
+	}
+	for name, l := range lists {
+		if len(l) == 0 {
+			empty = append(empty, name)
+		}
+	}
+	if len(empty) > 0 {
+		sort.Strings(empty)
+		return fmt.Errorf("search condition not loaded: %v", strings.Join(empty, ", "))
+	}
+	return nil
+}
+
+// checkDatabase db に ping し、expected のテーブルと列があるかを確認する
+func checkDatabase(ctx context.Context, db *sqlx.DB, expected map[string][]string) error {
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("ping failed: %w", err)
+	}
+
+	tables := make([]string, 0, len(expected))
+	for table := range expected {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	query, params, err := sqlx.In("SELECT table_name AS tbl, column_name AS col FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name IN (?)", tables)
+	if err != nil {
+		return err
+	}
+	var columns []struct {
+		Table  string `db:"tbl"`
+		Column string `db:"col"`
+	}
+	if err := db.SelectContext(ctx, &columns, query, params...); err != nil {
+		return fmt.Errorf("failed to read schema: %w", err)
+	}
+
+	found := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		found[c.Table+"."+c.Column] = true
+	}
+	missing := make([]string, 0)
+	for _, table := range tables {
+		for _, column := range expected[table] {
+			if !found[table+"."+column] {
+				missing = append(missing, table+"."+column)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing columns: %v", strings.Join(missing, ", "))
+	}
+	return nil
+}
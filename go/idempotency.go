@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// IdempotencyKeyHeader 同じ操作の再送であることを示すリクエストヘッダ
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader 保存しておいたレスポンスを返したときに付けるヘッダ
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	idempotencyKeyMaxLength  = 255
+	defaultIdempotencyWindow = 10 * time.Minute
+	idempotencySweepInterval = time.Minute
+	idempotencyBodyLimit     = 1 << 20
+)
+
+// loadIdempotencyWindow IDEMPOTENCY_WINDOW 環境変数 (10m などの time.Duration 形式) からレスポンスを保存しておく時間を決める
+func loadIdempotencyWindow() (time.Duration, error) {
+	v := getEnv("IDEMPOTENCY_WINDOW", "")
+	if v == "" {
+		return defaultIdempotencyWindow, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid IDEMPOTENCY_WINDOW %q", v)
+	}
+	return d, nil
+}
+
+// idempotentResponse 最初のリクエストに返したレスポンス
+type idempotentResponse struct {
+	// fingerprint リクエストのメソッド、パス、ボディのハッシュ。同じキーで違うリクエストが来たら 422 を返す
+	fingerprint [sha256.Size]byte
+	// done レスポンスが決まったら閉じる。それまで同じキーのリクエストは待たせる
+	done chan struct{}
+
+	status      int
+	contentType string
+	body        []byte
+	expiresAt   time.Time
+}
+
+// idempotencyStore Idempotency-Key ごとに最初のレスポンスを window の間保存する
+type idempotencyStore struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+}
+
+func newIdempotencyStore(window time.Duration) *idempotencyStore {
+	return &idempotencyStore{window: window, entries: map[string]*idempotentResponse{}}
+}
+
+// begin key の保存済みのレスポンスを返す。まだなければ新しく登録し、呼び出し側が最初のリクエストになる
+func (s *idempotencyStore) begin(key string, fingerprint [sha256.Size]byte) (*idempotentResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.entries[key]; ok {
+		select {
+		case <-r.done:
+			if time.Now().Before(r.expiresAt) {
+				return r, false
+			}
+		default:
+			// 最初のリクエストがまだ処理中
+			return r, false
+		}
+	}
+	r := &idempotentResponse{fingerprint: fingerprint, done: make(chan struct{})}
+	s.entries[key] = r
+	return r, true
+}
+
+// finish 最初のリクエストのレスポンスを保存して、待っているリクエストに知らせる
+// 5xx は一時的な失敗なので保存せず、再送されたら処理し直す
+func (s *idempotencyStore) finish(key string, r *idempotentResponse, status int, contentType string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.status, r.contentType, r.body = status, contentType, body
+	r.expiresAt = time.Now().Add(s.window)
+	if status >= http.StatusInternalServerError {
+		r.expiresAt = time.Time{}
+		if s.entries[key] == r {
+			delete(s.entries, key)
+		}
+	}
+	close(r.done)
+}
+
+// sweep 期限切れのレスポンスを捨てる
+func (s *idempotencyStore) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, r := range s.entries {
+		select {
+		case <-r.done:
+			if !now.Before(r.expiresAt) {
+				delete(s.entries, key)
+			}
+		default:
+		}
+	}
+}
+
+// clear 保存したレスポンスを全て捨てる
+func (s *idempotencyStore) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = map[string]*idempotentResponse{}
+}
+
+// runSweeper ctx が終わるまで定期的に期限切れのレスポンスを捨てる
+func (s *idempotencyStore) runSweeper(ctx context.Context) {
+	ticker := time.NewTicker(idempotencySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
+
+// responseRecorder ハンドラが書いたレスポンスを記録しながらクライアントに返す
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// middleware Idempotency-Key が付いたリクエストについて、同じキーの再送には最初のレスポンスをそのまま返す
+func (s *idempotencyStore) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > idempotencyKeyMaxLength {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "Idempotency-Key is too long"})
+		}
+
+		req := c.Request()
+		body, err := ioutil.ReadAll(http.MaxBytesReader(c.Response(), req.Body, idempotencyBodyLimit))
+		if err != nil {
+			return c.NoContent(http.StatusBadRequest)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		h := sha256.New()
+		fmt.Fprintf(h, "%v %v\n", req.Method, req.URL.Path)
+		h.Write(body)
+		var fingerprint [sha256.Size]byte
+		copy(fingerprint[:], h.Sum(nil))
+
+		r, first := s.begin(key, fingerprint)
+		if !first {
+			if r.fingerprint != fingerprint {
+				return c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Message: "Idempotency-Key is already used for a different request"})
+			}
+			select {
+			case <-r.done:
+			case <-req.Context().Done():
+				return req.Context().Err()
+			}
+			if r.expiresAt.IsZero() {
+				// 最初のリクエストが失敗したので、今回のリクエストを処理する
+				return s.middleware(next)(c)
+			}
+			c.Response().Header().Set(IdempotentReplayedHeader, "true")
+			if r.contentType != "" {
+				c.Response().Header().Set(echo.HeaderContentType, r.contentType)
+			}
+			c.Response().WriteHeader(r.status)
+			_, err := c.Response().Write(r.body)
+			return err
+		}
+
+		rec := &responseRecorder{ResponseWriter: c.Response().Writer, status: http.StatusOK}
+		c.Response().Writer = rec
+
+		// エラーや panic で終わった場合は echo 側がレスポンスを書くので、失敗として扱い保存しない
+		status, contentType, recorded := http.StatusInternalServerError, "", []byte(nil)
+		defer func() { s.finish(key, r, status, contentType, recorded) }()
+		if err := next(c); err != nil {
+			return err
+		}
+		status, contentType, recorded = rec.status, rec.Header().Get(echo.HeaderContentType), rec.body.Bytes()
+		return nil
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/labstack/echo"
+)
+
+// ImportMode 取り込む行の ID が既にあるときの扱い
+type ImportMode string
+
+const (
+	// ImportInsert 新しい行だけを追加する。既にある ID が一つでもあれば何も書き込まない
+	ImportInsert ImportMode = "insert"
+	// ImportUpsert 既にある ID の行は値を置き換える
+	ImportUpsert ImportMode = "upsert"
+	// ImportReplace upsert に加えて、アップロードに含まれない行を削除する
+	ImportReplace ImportMode = "replace"
+)
+
+// ImportSummary 取り込みで追加・更新・削除した行と、値が変わらなかった行の数
+type ImportSummary struct {
+	Inserted  int `json:"inserted"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Deleted   int `json:"deleted"`
+}
+
+// DuplicateIDError insert モードで既にある ID を取り込もうとしたことを表す
+type DuplicateIDError struct {
+	IDs []int64
+}
+
+func (e *DuplicateIDError) Error() string {
+	return fmt.Sprintf("%v ids already exist", len(e.IDs))
+}
+
+// getImportMode mode パラメータを読む。省略した場合は insert
+func getImportMode(c echo.Context) (ImportMode, error) {
+	switch mode := ImportMode(c.QueryParam("mode")); mode {
+	case "":
+		return ImportInsert, nil
+	case ImportInsert, ImportUpsert, ImportReplace:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown import mode %q", mode)
+	}
+}
+
+// add 一回の書き込みの件数を足す
+func (s *ImportSummary) add(o ImportSummary) {
+	s.Inserted += o.Inserted
+	s.Updated += o.Updated
+	s.Unchanged += o.Unchanged
+	s.Deleted += o.Deleted
+}
+
+// chairImport 取り込みの一回の書き込みで追加・更新する椅子
+type chairImport struct {
+	inserted []Chair
+	updated  []Chair
+	summary  ImportSummary
+}
+
+// planChairImport chairs を既にある椅子 existing と比べて書き込む内容を決める
+func planChairImport(chairs []Chair, existing map[int64]Chair, mode ImportMode) (*chairImport, error) {
+	p := &chairImport{}
+	dup := make([]int64, 0)
+	for _, chair := range chairs {
+		old, ok := existing[chair.ID]
+		switch {
+		case !ok:
+			p.inserted = append(p.inserted, chair)
+		case mode == ImportInsert:
+			dup = append(dup, chair.ID)
+		case old == chair:
+			p.summary.Unchanged++
+		default:
+			p.updated = append(p.updated, chair)
+		}
+	}
+	if len(dup) > 0 {
+		return nil, &DuplicateIDError{IDs: dup}
+	}
+	p.summary.Inserted = len(p.inserted)
+	p.summary.Updated = len(p.updated)
+	return p, nil
+}
+
+// subtractReservations 取り置きの分を除いた在庫にした chairs を返す
+// アップロードの在庫は取り置きを含む数なので、そのまま書くと期限切れの取り置きを戻したときに多すぎる在庫になる
+// 在庫より多く取り置かれた椅子は在庫を 0 にし、取り消す取り置きの数を excess に返す
+func subtractReservations(chairs []Chair, reserved map[int64]int64) (adjusted []Chair, excess map[int64]int64) {
+	adjusted = make([]Chair, len(chairs))
+	excess = map[int64]int64{}
+	for i, chair := range chairs {
+		if n := reserved[chair.ID]; n > 0 {
+			chair.Stock -= n
+			if chair.Stock < 0 {
+				excess[chair.ID] = -chair.Stock
+				chair.Stock = 0
+			}
+		}
+		adjusted[i] = chair
+	}
+	return adjusted, excess
+}
+
+// estateImport 取り込みの一回の書き込みで追加・更新する物件
+type estateImport struct {
+	inserted []Estate
+	updated  []Estate
+	summary  ImportSummary
+}
+
+// planEstateImport estates を既にある物件 existing と比べて書き込む内容を決める
+func planEstateImport(estates []Estate, existing map[int64]Estate, mode ImportMode) (*estateImport, error) {
+	p := &estateImport{}
+	dup := make([]int64, 0)
+	for _, estate := range estates {
+		old, ok := existing[estate.ID]
+		switch {
+		case !ok:
+			p.inserted = append(p.inserted, estate)
+		case mode == ImportInsert:
+			dup = append(dup, estate.ID)
+		case old == estate:
+			p.summary.Unchanged++
+		default:
+			p.updated = append(p.updated, estate)
+		}
+	}
+	if len(dup) > 0 {
+		return nil, &DuplicateIDError{IDs: dup}
+	}
+	p.summary.Inserted = len(p.inserted)
+	p.summary.Updated = len(p.updated)
+	return p, nil
+}
+
+// changed 更新した物件と追加した物件を返す
+func (p *estateImport) changed() []Estate {
+	changed := make([]Estate, 0, len(p.inserted)+len(p.updated))
+	changed = append(changed, p.inserted...)
+	return append(changed, p.updated...)
+}
+
+// missingIDs replace モードで削除する、existing のうち取り込んだ kept に含まれない ID を昇順で返す
+func missingIDs(existing []int64, kept map[int64]bool) []int64 {
+	missing := make([]int64, 0)
+	for _, id := range existing {
+		if !kept[id] {
+			missing = append(missing, id)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	return missing
+}
@@ -0,0 +1,58 @@
+package main
+
+import "sort"
+
+// recoInvalidateMaxEstates おすすめ物件キャッシュを追加した物件ごとに確かめる上限。これより多く追加したらキャッシュを全て捨てる
+const recoInvalidateMaxEstates = 10000
+
+// insertedEstates insert モードの取り込みで追加した物件のうち、キャッシュの更新に要るものだけを持つ
+// 大きな取り込みでも追加した物件を全てメモリに持たないようにする
+type insertedEstates struct {
+	limit int
+	// lowest rent ASC, id ASC で limit 件まで。これより後の物件は安い物件のキャッシュに入らない
+	lowest []Estate
+	// shapes おすすめ物件キャッシュの判定に使う ID、ドアの大きさ、popularity だけを写した物件
+	shapes []Estate
+	// overflow shapes が recoInvalidateMaxEstates を超えたので捨てたことを表す
+	overflow bool
+}
+
+func newInsertedEstates(limit int) *insertedEstates {
+	return &insertedEstates{limit: limit}
+}
+
+// add 書き込んだ estates を加える。estates は使い回してよい
+func (p *insertedEstates) add(estates []Estate) {
+	p.lowest = append(p.lowest, estates...)
+	sort.Slice(p.lowest, func(i, j int) bool {
+		if p.lowest[i].Rent != p.lowest[j].Rent {
+			return p.lowest[i].Rent < p.lowest[j].Rent
+		}
+		return p.lowest[i].ID < p.lowest[j].ID
+	})
+	if len(p.lowest) > p.limit {
+		p.lowest = p.lowest[:p.limit]
+	}
+
+	if p.overflow {
+		return
+	}
+	if len(p.shapes)+len(estates) > recoInvalidateMaxEstates {
+		p.overflow = true
+		p.shapes = nil
+		return
+	}
+	for _, estate := range estates {
+		p.shapes = append(p.shapes, Estate{ID: estate.ID, DoorHeight: estate.DoorHeight, DoorWidth: estate.DoorWidth, Popularity: estate.Popularity})
+	}
+}
+
+// applyInsertedEstates 取り込みをコミットした後に、追加した物件をキャッシュに反映する
+func (s *server) applyInsertedEstates(p *insertedEstates) {
+	s.lowPricedEstates.merge(p.lowest)
+	if p.overflow {
+		s.recommendedEstates.clear()
+	} else {
+		s.recommendedEstates.invalidate(p.shapes)
+	}
+}
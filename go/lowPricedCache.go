@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// cachePrimaryRefillWindow キャッシュを無効にしてからこの間に読み込み直す場合はプライマリから読む
+// 書き込みを反映していないリードレプリカの結果を、次に無効にするまでキャッシュし続けないようにする
+const cachePrimaryRefillWindow = 10 * time.Second
+
+// CacheStats キャッシュのヒット数とミス数
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// lowPricedEstateCache rent ASC, id ASC で上位 limit 件の物件を保持するキャッシュ
+type lowPricedEstateCache struct {
+	limit int
+
+	mu sync.RWMutex
+	// estates nil ならまだ読み込んでいない
+	estates []Estate
+	// gen clear や読み込み前の merge のたびに増やし、古い読み込み結果で上書きしないようにする
+	gen uint64
+	// invalidatedAt 最後に clear か merge をした時刻
+	invalidatedAt time.Time
+
+	hits   uint64
+	misses uint64
+}
+
+func newLowPricedEstateCache(limit int) *lowPricedEstateCache {
+	return &lowPricedEstateCache{limit: limit}
+}
+
+// get キャッシュされた物件を返す。ミスした場合は set に渡す世代を返す
+func (c *lowPricedEstateCache) get() ([]Estate, uint64, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.estates != nil {
+		atomic.AddUint64(&c.hits, 1)
+		return c.estates, c.gen, true
+	}
+	atomic.AddUint64(&c.misses, 1)
+	return nil, c.gen, false
+}
+
+// set DB から読み込んだ物件をキャッシュする。get の後に clear や merge があった場合は捨てる
+func (c *lowPricedEstateCache) set(estates []Estate, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gen != gen || c.estates != nil {
+		return
+	}
+	c.estates = estates
+}
+
+// merge 追加された物件をキャッシュに取り込む
+// 追加をコミットした後に読み込んだ結果が先に set されていることがあるので、既にある ID は重ねずに置き換える
+func (c *lowPricedEstateCache) merge(inserted []Estate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invalidatedAt = time.Now()
+	if c.estates == nil {
+		c.gen++
+		return
+	}
+	// 読み込み中の get が返したスライスを書き換えないよう、新しいスライスを作る
+	merged := make([]Estate, 0, len(c.estates)+len(inserted))
+	seen := make(map[int64]bool, len(inserted))
+	for _, estate := range inserted {
+		if !seen[estate.ID] {
+			seen[estate.ID] = true
+			merged = append(merged, estate)
+		}
+	}
+	for _, estate := range c.estates {
+		if !seen[estate.ID] {
+			merged = append(merged, estate)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].Rent != merged[j].Rent {
+			return merged[i].Rent < merged[j].Rent
+		}
+		return merged[i].ID < merged[j].ID
+	})
+	if len(merged) > c.limit {
+		merged = merged[:c.limit]
+	}
+	c.estates = merged
+}
+
+// clear キャッシュを捨てる
+func (c *lowPricedEstateCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.estates = nil
+	c.gen++
+	c.invalidatedAt = time.Now()
+}
+
+// refillFromPrimary 書き込みの直後なので、読み込み直すときはプライマリから読むべきかを返す
+func (c *lowPricedEstateCache) refillFromPrimary() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return time.Since(c.invalidatedAt) < cachePrimaryRefillWindow
+}
+
+func (c *lowPricedEstateCache) stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
+
+func (s *server) getCacheStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]CacheStats{
+		"lowPricedEstate":   s.lowPricedEstates.stats(),
+		"recommendedEstate": s.recommendedEstates.stats(),
+	})
+}
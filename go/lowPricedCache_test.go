@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLowPricedEstateCacheMergeSkipsCachedIDs(t *testing.T) {
+	c := newLowPricedEstateCache(2)
+	_, gen, _ := c.get()
+	// 追加をコミットした後の読み込み結果が merge より先に set された場合
+	c.set([]Estate{{ID: 10, Rent: 1}, {ID: 1, Rent: 5}}, gen)
+	c.merge([]Estate{{ID: 10, Rent: 1}})
+
+	estates, _, ok := c.get()
+	if !ok || len(estates) != 2 || estates[0].ID != 10 || estates[1].ID != 1 {
+		t.Fatalf("cached = %+v", estates)
+	}
+}
+
+func TestLowPricedEstateCacheMergeKeepsTopLimit(t *testing.T) {
+	c := newLowPricedEstateCache(3)
+	_, gen, _ := c.get()
+	c.set([]Estate{{ID: 1, Rent: 10}, {ID: 2, Rent: 20}, {ID: 3, Rent: 30}}, gen)
+	c.merge([]Estate{{ID: 5, Rent: 20}, {ID: 4, Rent: 5}, {ID: 6, Rent: 40}})
+
+	estates, _, _ := c.get()
+	got := make([]int64, 0, len(estates))
+	for _, estate := range estates {
+		got = append(got, estate.ID)
+	}
+	if fmt.Sprint(got) != "[4 1 2]" {
+		t.Fatalf("cached ids = %v, want [4 1 2]", got)
+	}
+}
+
+func TestLowPricedEstateConcurrentWithPostEstate(t *testing.T) {
+	s, e := newTestServer(t)
+
+	const uploads = 50
+	var wg sync.WaitGroup
+	errs := make(chan string, 1000)
+	for i := 0; i < uploads; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			var rows strings.Builder
+			for j := int64(0); j < 5; j++ {
+				id := int64(i)*5 + j + 1
+				// 後の upload ほど安くして、キャッシュの上位を入れ替え続ける
+				rows.WriteString(estateCSVRow(id, 100000-id*10, 100, 100, 35, 139))
+			}
+			if rec := uploadCSV(e, "/api/estate", "estates", rows.String()); rec.Code != http.StatusCreated {
+				errs <- fmt.Sprintf("postEstate: %v %s", rec.Code, rec.Body.String())
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				rec := doRequest(e, http.MethodGet, "/api/estate/low_priced", nil, "")
+				var res EstateListResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+					errs <- err.Error()
+					return
+				}
+				if id, ok := duplicateEstateID(res.Estates); ok {
+					errs <- fmt.Sprintf("low_priced returned estate %v twice", id)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	want, err := s.estates.LowPricedEstates(context.Background(), Limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res EstateListResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/estate/low_priced", nil, ""), &res)
+	if len(res.Estates) != len(want) {
+		t.Fatalf("cached %v estates, want %v", len(res.Estates), len(want))
+	}
+	for i := range want {
+		if res.Estates[i].ID != want[i].ID {
+			t.Fatalf("cached[%v] = %v, want %v", i, res.Estates[i].ID, want[i].ID)
+		}
+	}
+}
+
+func duplicateEstateID(estates []Estate) (int64, bool) {
+	seen := map[int64]bool{}
+	for _, estate := range estates {
+		if seen[estate.ID] {
+			return estate.ID, true
+		}
+		seen[estate.ID] = true
+	}
+	return 0, false
+}
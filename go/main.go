@@ -1,24 +1,22 @@
 package main
 
 import (
-	"bytes"
-	"database/sql"
-	"encoding/csv"
+	"context"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/goccy/go-json"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/isucon/isucon10-qualify/isuumo/spatial"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
@@ -27,9 +25,6 @@ import (
 const Limit = 20
 const NazotteLimit = 50
 
-var dbChair *sqlx.DB
-var dbEstate *sqlx.DB
-var mySQLConnectionData *MySQLConnectionEnv
 var chairSearchCondition ChairSearchCondition
 var estateSearchCondition EstateSearchCondition
 
@@ -37,6 +32,10 @@ type InitializeResponse struct {
 	Language string `json:"language"`
 }
 
+type ErrorResponse struct {
+	Message string `json:"message"`
+}
+
 type Chair struct {
 	ID          int64  `db:"id" json:"id"`
 	Name        string `db:"name" json:"name"`
@@ -48,9 +47,11 @@ type Chair struct {
 	Depth       int64  `db:"depth" json:"depth"`
 	Color       string `db:"color" json:"color"`
 	Features    string `db:"features" json:"features"`
-	Kind        string `db:"kind" json:"kind"`
-	Popularity  int64  `db:"popularity" json:"-"`
-	Stock       int64  `db:"stock" json:"-"`
+	// FeaturesMask Features の各特徴の feature_id 番目のビットを立てたもの
+	FeaturesMask uint64 `db:"features_mask" json:"-"`
+	Kind         string `db:"kind" json:"kind"`
+	Popularity   int64  `db:"popularity" json:"-"`
+	Stock        int64  `db:"stock" json:"-"`
 }
 
 type ChairSearchResponse struct {
@@ -62,6 +63,21 @@ type ChairListResponse struct {
 	Chairs []Chair `json:"chairs"`
 }
 
+// Order 椅子の購入記録
+type Order struct {
+	ID        int64     `db:"id" json:"id"`
+	ChairID   int64     `db:"chair_id" json:"chairId"`
+	Email     string    `db:"email" json:"email"`
+	Price     int64     `db:"price" json:"price"`
+	Quantity  int64     `db:"quantity" json:"quantity"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+type OrderListResponse struct {
+	Count  int64   `json:"count"`
+	Orders []Order `json:"orders"`
+}
+
 //Estate 物件
 type Estate struct {
 	ID          int64   `db:"id" json:"id"`
@@ -75,7 +91,9 @@ type Estate struct {
 	DoorHeight  int64   `db:"door_height" json:"doorHeight"`
 	DoorWidth   int64   `db:"door_width" json:"doorWidth"`
 	Features    string  `db:"features" json:"features"`
-	Popularity  int64   `db:"popularity" json:"-"`
+	// FeaturesMask Features の各特徴の feature_id 番目のビットを立てたもの
+	FeaturesMask uint64 `db:"features_mask" json:"-"`
+	Popularity   int64  `db:"popularity" json:"-"`
 }
 
 //EstateSearchResponse estate/searchへのレスポンスの形式
@@ -130,13 +148,6 @@ type ChairSearchCondition struct {
 	Kind    ListCondition  `json:"kind"`
 }
 
-type BoundingBox struct {
-	// TopLeftCorner 緯度経度が共に最小値になるような点の情報を持っている
-	TopLeftCorner Coordinate
-	// BottomRightCorner 緯度経度が共に最大値になるような点の情報を持っている
-	BottomRightCorner Coordinate
-}
-
 type MySQLConnectionEnv struct {
 	Host     string
 	Port     string
@@ -150,6 +161,8 @@ type RecordMapper struct {
 
 	offset int
 	err    error
+	// errs 列ごとの読み取りエラー。Err と違い、読めない列があっても残りの列を読み続けて全て記録する
+	errs []error
 }
 
 func getSizeId(size int) int {
@@ -201,11 +214,10 @@ func getRentPriceId(price int) int {
 }
 
 func (r *RecordMapper) next() (string, error) {
-	if r.err != nil {
-		return "", r.err
-	}
 	if r.offset >= len(r.Record) {
-		r.err = fmt.Errorf("too many read")
+		if r.err == nil {
+			r.err = fmt.Errorf("too many read")
+		}
 		return "", r.err
 	}
 	s := r.Record[r.offset]
@@ -213,6 +225,15 @@ func (r *RecordMapper) next() (string, error) {
 	return s, nil
 }
 
+// fail 直前に読んだ列のエラーを記録する
+func (r *RecordMapper) fail(err error) {
+	err = fmt.Errorf("column %v: %w", r.offset, err)
+	if r.err == nil {
+		r.err = err
+	}
+	r.errs = append(r.errs, err)
+}
+
 func (r *RecordMapper) NextInt() int {
 	s, err := r.next()
 	if err != nil {
@@ -220,7 +241,7 @@ func (r *RecordMapper) NextInt() int {
 	}
 	i, err := strconv.Atoi(s)
 	if err != nil {
-		r.err = err
+		r.fail(fmt.Errorf("%q is not an integer", s))
 		return 0
 	}
 	return i
@@ -233,7 +254,7 @@ func (r *RecordMapper) NextFloat() float64 {
 	}
 	f, err := strconv.ParseFloat(s, 64)
 	if err != nil {
-		r.err = err
+		r.fail(fmt.Errorf("%q is not a number", s))
 		return 0
 	}
 	return f
@@ -251,6 +272,14 @@ func (r *RecordMapper) Err() error {
 	return r.err
 }
 
+// Errs 読み取りで起きた全てのエラーを返す
+func (r *RecordMapper) Errs() []error {
+	if len(r.errs) == 0 && r.err != nil {
+		return []error{r.err}
+	}
+	return r.errs
+}
+
 func NewMySQLConnectionEnv() *MySQLConnectionEnv {
 	return &MySQLConnectionEnv{
 		Host:     getEnv("MYSQL_HOST", "127.0.0.1"),
@@ -261,6 +290,25 @@ func NewMySQLConnectionEnv() *MySQLConnectionEnv {
 	}
 }
 
+// NewMySQLReplicaConnectionEnvs key の環境変数にカンマ区切りで並べた host:port をリードレプリカの接続先にする
+// ユーザやパスワード、データベース名は primary と同じものを使う
+func NewMySQLReplicaConnectionEnvs(key string, primary *MySQLConnectionEnv) []*MySQLConnectionEnv {
+	replicas := make([]*MySQLConnectionEnv, 0)
+	for _, addr := range strings.Split(getEnv(key, ""), ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		replica := *primary
+		replica.Host, replica.Port = addr, "3306"
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			replica.Host, replica.Port = addr[:i], addr[i+1:]
+		}
+		replicas = append(replicas, &replica)
+	}
+	return replicas
+}
+
 func getEnv(key, defaultValue string) string {
 	val := os.Getenv(key)
 	if val != "" {
@@ -271,13 +319,7 @@ func getEnv(key, defaultValue string) string {
 
 //ConnectDB isuumoデータベースに接続する
 func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, error) {
-	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
-	return sqlx.Open("mysql", dsn)
-}
-
-//ConnectDB isuumoデータベースに接続する
-func (mc *MySQLConnectionEnv) ConnectDBEstate() (*sqlx.DB, error) {
-	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", "isucon", "isucon", "10.161.78.103", 3306, "isuumo")
+	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
 	return sqlx.Open("mysql", dsn)
 }
 
@@ -295,6 +337,17 @@ func init() {
 		os.Exit(1)
 	}
 	json.Unmarshal(jsonText, &estateSearchCondition)
+
+	chairFeatureIDs, err = newFeatureIDs(chairSearchCondition.Feature)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	estateFeatureIDs, err = newFeatureIDs(estateSearchCondition.Feature)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
 }
 
 func main() {
@@ -305,130 +358,251 @@ func main() {
 	// Middleware
 	e.Use(middleware.Recover())
 	e.Use(customMiddleware)
+	e.Use(trackWrites)
 
-	// pprof
-	//e.GET("/debug/pprof/*", echo.WrapHandler(http.DefaultServeMux))
-
-	// Initialize
-	e.POST("/initialize", initialize)
-
-	// Chair Handler
-	e.GET("/api/chair/:id", getChairDetail)
-	e.POST("/api/chair", postChair)
-	e.GET("/api/chair/search", searchChairs)
-	e.GET("/api/chair/low_priced", getLowPricedChair)
-	e.GET("/api/chair/search/condition", getChairSearchCondition)
-	e.POST("/api/chair/buy/:id", buyChair)
-
-	// Estate Handler
-	e.GET("/api/estate/:id", getEstateDetail)
-	e.POST("/api/estate", postEstate)
-	e.GET("/api/estate/search", searchEstates)
-	e.GET("/api/estate/low_priced", getLowPricedEstate)
-	e.POST("/api/estate/req_doc/:id", postEstateRequestDocument)
-	e.POST("/api/estate/nazotte", searchEstateNazotte)
-	e.GET("/api/estate/search/condition", getEstateSearchCondition)
-	e.GET("/api/recommended_estate/:id", searchRecommendedEstateWithChair)
-
-	mySQLConnectionData = NewMySQLConnectionEnv()
+	dbConfig, err := LoadDBConfig()
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
 
-	var err error
-	for {
-		dbChair, err = mySQLConnectionData.ConnectDB()
-		if err == nil {
-			break
-		}
-		time.Sleep(1 * time.Second)
+	dbChair, err := openDB("chair", dbConfig.Chair, e.Logger)
+	if err != nil {
+		e.Logger.Fatal(err)
 	}
 	dbChair.SetMaxOpenConns(32)
 	dbChair.SetMaxIdleConns(32)
-	defer dbChair.Close()
+	chairDB := newDBRouter(dbChair)
+	if err := connectReplicas(chairDB, dbConfig.ChairReplicas); err != nil {
+		e.Logger.Fatal(err)
+	}
 
-	for {
-		dbEstate, err = mySQLConnectionData.ConnectDBEstate()
-		if err == nil {
-			break
-		}
-		time.Sleep(1 * time.Second)
+	dbEstate, err := openDB("estate", dbConfig.Estate, e.Logger)
+	if err != nil {
+		e.Logger.Fatal(err)
 	}
 	dbEstate.SetMaxOpenConns(32)
 	dbEstate.SetMaxIdleConns(32)
-	defer dbEstate.Close()
+	estateDB := newDBRouter(dbEstate)
+	if err := connectReplicas(estateDB, dbConfig.EstateReplicas); err != nil {
+		e.Logger.Fatal(err)
+	}
 
-	// Start server
-	serverPort := fmt.Sprintf(":%v", getEnv("SERVER_PORT", "1323"))
-	e.Logger.Fatal(e.Start(serverPort))
-}
+	shutdownTimeout, err := loadShutdownTimeout()
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
 
-func initialize(c echo.Context) error {
-	sqlDir := filepath.Join("..", "mysql", "db")
-	paths2 := []string{
-		filepath.Join(sqlDir, "0_Schema.sql"),
-		filepath.Join(sqlDir, "2_DummyChairData.sql"),
-		filepath.Join(sqlDir, "3_AddRange.sql"),
+	idempotencyWindow, err := loadIdempotencyWindow()
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	documentRequestInterval, err := loadDocumentRequestInterval()
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	reservationTTL, err := loadReservationTTL()
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	csvImport, err := loadCSVImportConfig()
+	if err != nil {
+		e.Logger.Fatal(err)
 	}
 
-	paths3 := []string{
-		filepath.Join(sqlDir, "0_Schema.sql"),
-		filepath.Join(sqlDir, "1_DummyEstateData.sql"),
-		filepath.Join(sqlDir, "3_AddRange.sql"),
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	go chairDB.runHealthCheck(bgCtx, e.Logger)
+	go estateDB.runHealthCheck(bgCtx, e.Logger)
+
+	estates := newMySQLEstateStore(estateDB, e.Logger, csvImport.ChunkSize)
+	chairStore := newMySQLChairStore(chairDB, e.Logger, csvImport.ChunkSize)
+	if dbConfig.SharedDatabase() {
+		// 0_Schema.sql はデータベースを作り直すので、同じデータベースなら椅子の初期化で両方のデータをまとめて入れる
+		chairStore.scripts = sharedSQLScripts
+		estates.scripts = nil
+	}
+	if err := estates.loadIndex(context.Background()); err != nil {
+		e.Logger.Errorf("failed to load estate index : %v", err)
 	}
+	chairs := newChairCatalog(chairStore)
+	if err := chairs.load(context.Background()); err != nil {
+		e.Logger.Errorf("failed to load chairs : %v", err)
+	}
+	s := &server{
+		chairs:  chairs,
+		estates: estates,
+
+		chairDB:  chairDB,
+		estateDB: estateDB,
+
+		sharedDatabase: dbConfig.SharedDatabase(),
+
+		lowPricedEstates:   newLowPricedEstateCache(Limit),
+		recommendedEstates: newRecoCache(recoCacheSize, Limit),
 
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+		idempotency: newIdempotencyStore(idempotencyWindow),
 
+		documentNotifier:        newDocumentRequestNotifier(e.Logger),
+		documentRequestInterval: documentRequestInterval,
+		reservationTTL:          reservationTTL,
+		csvImport:               csvImport,
+		adminToken:              getEnv("ADMIN_TOKEN", ""),
+	}
+	if s.adminToken == "" {
+		e.Logger.Warnf("ADMIN_TOKEN is not set, admin endpoints are disabled")
+	}
+	go s.idempotency.runSweeper(bgCtx)
+	go s.runReservationSweeper(bgCtx, e.Logger)
+
+	s.registerRoutes(e)
+
+	// Start server
+	serverPort := fmt.Sprintf(":%v", getEnv("SERVER_PORT", "1323"))
 	go func() {
-		for _, p := range paths2 {
-			sqlFile, _ := filepath.Abs(p)
-			cmdStr := fmt.Sprintf("mysql -h %v -u %v -p%v -P %v < %v",
-				mySQLConnectionData.Host,
-				mySQLConnectionData.User,
-				mySQLConnectionData.Password,
-				mySQLConnectionData.Port,
-				sqlFile,
-			)
-			if err := exec.Command("bash", "-c", cmdStr).Run(); err != nil {
-				c.Logger().Panicf("Initialize script error : %v", err)
-			}
+		if err := e.Start(serverPort); err != nil && err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
 		}
-		wg.Done()
 	}()
 
-	go func() {
-		for _, p := range paths3 {
-			sqlFile, _ := filepath.Abs(p)
-			cmdStr := fmt.Sprintf("mysql -h %v -u %v -p%v -P %v  < %v",
-				"10.161.78.103",
-				"isucon",
-				"isucon",
-				3306,
-				sqlFile,
-			)
-			if err := exec.Command("bash", "-c", cmdStr).Run(); err != nil {
-				c.Logger().Panicf("Initialize script error : %v", err)
-			}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-quit
+	e.Logger.Infof("received %v, shutting down", sig)
+
+	stopBackground()
+	s.shutdown(e, shutdownTimeout)
+}
+
+// server 各ハンドラが使う椅子と物件の保存先
+type server struct {
+	chairs  ChairStore
+	estates EstateStore
+
+	// chairDB, estateDB /readyz で確認するコネクションプール
+	chairDB  *dbRouter
+	estateDB *dbRouter
+	// sharedDatabase 椅子と物件が同じデータベースを使うなら true。初期化を順に行う
+	sharedDatabase bool
+
+	lowPricedEstates   *lowPricedEstateCache
+	recommendedEstates *recoCache
+
+	// idempotency 購入や資料請求の再送に最初のレスポンスを返すための保存先
+	idempotency *idempotencyStore
+
+	// documentNotifier 資料請求を知らせる先
+	documentNotifier DocumentRequestNotifier
+	// documentRequestInterval 同じメールアドレスから同じ物件へ続けて資料請求できるまでの時間
+	documentRequestInterval time.Duration
+	// reservationTTL 椅子の取り置きを保持する時間
+	reservationTTL time.Duration
+	// csvImport postChair / postEstate の CSV の取り込みの設定
+	csvImport csvImportConfig
+	// adminToken /admin と /debug のエンドポイントに必要なトークン。空なら無効にする
+	adminToken string
+}
+
+// registerRoutes e に各ハンドラを登録する
+func (s *server) registerRoutes(e *echo.Echo) {
+	// pprof
+	//e.GET("/debug/pprof/*", echo.WrapHandler(http.DefaultServeMux))
+	adminOnly := adminAuth(s.adminToken)
+	debug := e.Group("/debug", adminOnly)
+	debug.GET("/estate_index", s.checkEstateIndex)
+	debug.GET("/cache_stats", s.getCacheStats)
+
+	// Health check
+	e.GET("/healthz", healthz)
+	e.GET("/readyz", s.readyz)
+
+	// Initialize
+	e.POST("/initialize", s.initialize)
+
+	// Admin
+	admin := e.Group("/admin", adminOnly)
+	admin.GET("/document_requests", s.getDocumentRequests)
+	admin.POST("/document_requests/:id/status", s.updateDocumentRequestStatus)
+
+	// Chair Handler
+	e.GET("/api/chair/:id", s.getChairDetail)
+	e.POST("/api/chair", s.postChair)
+	e.GET("/api/chair/search", s.searchChairs)
+	e.GET("/api/chair/export", s.exportChairs)
+	e.GET("/api/chair/low_priced", s.getLowPricedChair)
+	e.GET("/api/chair/search/condition", getChairSearchCondition)
+	e.POST("/api/chair/buy/:id", s.buyChair, s.idempotency.middleware)
+	e.POST("/api/chair/checkout", s.checkoutChairs, s.idempotency.middleware)
+	e.POST("/api/chair/reserve/:id", s.reserveChair)
+	// 購入記録はサポート向けで、メールアドレスを含むので管理用のトークンが要る
+	e.GET("/api/chair/:id/orders", s.getChairOrders, adminOnly)
+
+	// Order Handler
+	e.GET("/api/orders", s.getOrders, adminOnly)
+
+	// Estate Handler
+	e.GET("/api/estate/:id", s.getEstateDetail)
+	e.POST("/api/estate", s.postEstate)
+	e.GET("/api/estate/search", s.searchEstates)
+	e.GET("/api/estate/export", s.exportEstates)
+	e.GET("/api/estate/low_priced", s.getLowPricedEstate)
+	e.POST("/api/estate/req_doc/:id", s.postEstateRequestDocument, s.idempotency.middleware)
+	e.POST("/api/estate/nazotte", s.searchEstateNazotte)
+	e.GET("/api/estate/search/condition", getEstateSearchCondition)
+	e.GET("/api/recommended_estate/:id", s.searchRecommendedEstateWithChair)
+}
+
+func (s *server) initialize(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var chairErr, estateErr error
+	if s.sharedDatabase {
+		// 椅子の初期化で物件のデータも入れるので、物件はその後でインデックスだけを読み直す
+		chairErr = s.chairs.Initialize(ctx)
+		if chairErr == nil {
+			estateErr = s.estates.Initialize(ctx)
 		}
-		wg.Done()
-	}()
+	} else {
+		wg := sync.WaitGroup{}
+		wg.Add(2)
 
-	wg.Wait()
+		go func() {
+			chairErr = s.chairs.Initialize(ctx)
+			wg.Done()
+		}()
+
+		go func() {
+			estateErr = s.estates.Initialize(ctx)
+			wg.Done()
+		}()
+
+		wg.Wait()
+	}
+
+	for _, err := range []error{chairErr, estateErr} {
+		if err != nil {
+			c.Logger().Errorf("Initialize script error : %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Message: err.Error()})
+		}
+	}
+
+	s.lowPricedEstates.clear()
+	s.recommendedEstates.clear()
+	// 初期化前の購入や資料請求のレスポンスを返さないようにする
+	s.idempotency.clear()
 
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "go",
 	})
 }
 
-func getChairDetail(c echo.Context) error {
+func (s *server) getChairDetail(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	chair := Chair{}
-	query := `SELECT id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock FROM chair WHERE id = ? LIMIT 1`
-	err = dbChair.Get(&chair, query, id)
+	chair, err := s.chairs.GetChair(c.Request().Context(), int64(id))
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == ErrNotFound {
 			return c.NoContent(http.StatusNotFound)
 		}
 		return c.NoContent(http.StatusInternalServerError)
@@ -439,178 +613,175 @@ func getChairDetail(c echo.Context) error {
 	return c.JSON(http.StatusOK, chair)
 }
 
-func postChair(c echo.Context) error {
-	header, err := c.FormFile("chairs")
+// postChair 有効な行を ChunkSize 件ずつ書き込み、アップロード全体をメモリに持たない
+// 問題のある行が見つかったら以降は書き込まずに検証だけを続け、最後にロールバックする
+func (s *server) postChair(c echo.Context) error {
+	dryRun, err := getDryRun(c)
 	if err != nil {
 		return c.NoContent(http.StatusBadRequest)
 	}
-	f, err := header.Open()
+	mode, err := getImportMode(c)
 	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
 	}
-	defer f.Close()
-	records, err := csv.NewReader(f).ReadAll()
-	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+
+	ctx := c.Request().Context()
+	var importer ChairImporter
+	if !dryRun {
+		importer, err = s.chairs.ImportChairs(ctx, mode)
+		if err != nil {
+			c.Logger().Errorf("failed to start importing chairs: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		defer importer.Rollback()
 	}
 
-	tx, err := dbChair.Begin()
-	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+	report := newImportReport(mode, dryRun)
+	ids := idSet{}
+	batch := make([]Chair, 0, s.csvImport.ChunkSize)
+	var writeErr error
+	flush := func() {
+		if len(batch) > 0 && writeErr == nil && !report.failed() {
+			writeErr = importer.Write(ctx, batch)
+		}
+		batch = batch[:0]
 	}
-	defer tx.Rollback()
-	query := &bytes.Buffer{}
-	values := make([]interface{}, 0, len(records)*13)
-	for _, row := range records {
-		//fmt.Println(row)
-		rm := RecordMapper{Record: row}
-		id := rm.NextInt()
-		name := rm.NextString()
-		description := rm.NextString()
-		thumbnail := rm.NextString()
-		price := rm.NextInt()
-		height := rm.NextInt()
-		width := rm.NextInt()
-		depth := rm.NextInt()
-		color := rm.NextString()
-		features := rm.NextString()
-		kind := rm.NextString()
-		popularity := rm.NextInt()
-		stock := rm.NextInt()
-		heightRange := getSizeId(height)
-		widthRange := getSizeId(width)
-		depthRange := getSizeId(depth)
-		priceRange := getChairPriceId(price)
-		if err := rm.Err(); err != nil {
-			return c.NoContent(http.StatusBadRequest)
+	// CSV でも NDJSON でも同じように検証して同じ経路で書き込む
+	err = s.csvImport.readChairs(c, func(line int, chair Chair, reasons []string) {
+		if len(reasons) == 0 {
+			reasons = ids.check(chair.ID, line)
 		}
-		io.WriteString(query, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?),")
-		values = append(values, id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock, heightRange, widthRange, depthRange, priceRange)
+		report.add(line, reasons)
+		if len(reasons) == 0 && importer != nil {
+			batch = append(batch, chair)
+			if len(batch) >= s.csvImport.ChunkSize {
+				flush()
+			}
+		}
+	})
+	if err != nil {
+		return s.uploadReadError(c, report, err)
 	}
-	valueStr := query.String()
-	if _, err := tx.Exec("INSERT INTO chair(id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock, height_range, width_range, depth_range, price_range) VALUES "+valueStr[:len(valueStr)-1], values...); err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+	if importer != nil {
+		flush()
 	}
-	if err := tx.Commit(); err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+	if writeErr != nil {
+		return s.importWriteError(c, report, ids, writeErr)
+	}
+	if report.failed() || dryRun {
+		return c.JSON(importReportStatus(report), report)
 	}
-	return c.NoContent(http.StatusCreated)
+	summary, err := importer.Commit(ctx)
+	if err != nil {
+		return s.importWriteError(c, report, ids, err)
+	}
+	report.Summary = &summary
+	return c.JSON(importReportStatus(report), report)
 }
 
-func searchChairs(c echo.Context) error {
-	conditions := make([]string, 0)
-	params := make([]interface{}, 0)
+// parseChairSearchQuery 椅子の検索条件をクエリパラメータから読む。ページ指定は読まない
+func parseChairSearchQuery(c echo.Context) (ChairSearchQuery, error) {
+	q := ChairSearchQuery{}
 
 	if c.QueryParam("priceRangeId") != "" {
-		chairPrice, err := getRange(chairSearchCondition.Price, c.QueryParam("priceRangeId"))
+		chairPrices, err := getRanges(chairSearchCondition.Price, c.QueryParam("priceRangeId"))
 		if err != nil {
-			return c.NoContent(http.StatusBadRequest)
+			return q, err
 		}
-		conditions = append(conditions, "price_range = ?")
-		params = append(params, chairPrice.ID)
+		q.PriceRangeIDs = rangeIDs(chairPrices)
 	}
 
 	if c.QueryParam("heightRangeId") != "" {
-		chairHeight, err := getRange(chairSearchCondition.Height, c.QueryParam("heightRangeId"))
+		chairHeights, err := getRanges(chairSearchCondition.Height, c.QueryParam("heightRangeId"))
 		if err != nil {
-			return c.NoContent(http.StatusBadRequest)
+			return q, err
 		}
-
-		conditions = append(conditions, "height_range = ?")
-		params = append(params, chairHeight.ID)
+		q.HeightRangeIDs = rangeIDs(chairHeights)
 	}
 
 	if c.QueryParam("widthRangeId") != "" {
-		chairWidth, err := getRange(chairSearchCondition.Width, c.QueryParam("widthRangeId"))
+		chairWidths, err := getRanges(chairSearchCondition.Width, c.QueryParam("widthRangeId"))
 		if err != nil {
-			return c.NoContent(http.StatusBadRequest)
+			return q, err
 		}
-
-		conditions = append(conditions, "width_range = ?")
-		params = append(params, chairWidth.ID)
+		q.WidthRangeIDs = rangeIDs(chairWidths)
 	}
 
 	if c.QueryParam("depthRangeId") != "" {
-		chairDepth, err := getRange(chairSearchCondition.Depth, c.QueryParam("depthRangeId"))
+		chairDepths, err := getRanges(chairSearchCondition.Depth, c.QueryParam("depthRangeId"))
 		if err != nil {
-			return c.NoContent(http.StatusBadRequest)
+			return q, err
 		}
-		conditions = append(conditions, "depth_range = ?")
-		params = append(params, chairDepth.ID)
+		q.DepthRangeIDs = rangeIDs(chairDepths)
 	}
 
 	if c.QueryParam("kind") != "" {
-		conditions = append(conditions, "kind = ?")
-		params = append(params, c.QueryParam("kind"))
+		kinds, err := getListValues(chairSearchCondition.Kind, c.QueryParam("kind"))
+		if err != nil {
+			return q, err
+		}
+		q.Kinds = kinds
 	}
 
 	if c.QueryParam("color") != "" {
-		conditions = append(conditions, "color = ?")
-		params = append(params, c.QueryParam("color"))
+		colors, err := getListValues(chairSearchCondition.Color, c.QueryParam("color"))
+		if err != nil {
+			return q, err
+		}
+		q.Colors = colors
 	}
 
 	if c.QueryParam("features") != "" {
-		featureParams := strings.Split(c.QueryParam("features"), ",")
-		for _, f := range featureParams {
-			conditions = append(conditions, "features LIKE CONCAT('%', ?, '%')")
-			params = append(params, f)
-		}
-		if len(featureParams) > 1 {
-			time.Sleep(time.Millisecond * 500)
+		featureIDs, err := chairFeatureIDs.lookup(strings.Split(c.QueryParam("features"), ","))
+		if err != nil {
+			return q, err
 		}
+		q.FeaturesMask = featuresMask(featureIDs)
 	}
 
-	if len(conditions) == 0 {
-		return c.NoContent(http.StatusBadRequest)
+	return q, nil
+}
+
+func (s *server) searchChairs(c echo.Context) error {
+	q, err := parseChairSearchQuery(c)
+	if err != nil {
+		return searchQueryError(c, err)
 	}
 
-	conditions = append(conditions, "stock > 0")
+	if q.empty() {
+		return c.NoContent(http.StatusBadRequest)
+	}
 
-	page, err := strconv.Atoi(c.QueryParam("page"))
+	q.Page, err = strconv.Atoi(c.QueryParam("page"))
 	if err != nil {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	q.PerPage, err = strconv.Atoi(c.QueryParam("perPage"))
 	if err != nil {
 		c.Logger().Infof("Invalid format perPage parameter : %v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	searchQuery := "SELECT id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock FROM chair WHERE "
-	countQuery := "SELECT COUNT(id) FROM chair WHERE "
-	searchCondition := strings.Join(conditions, " AND ")
-	limitOffset := " ORDER BY popularity DESC, id ASC LIMIT ? OFFSET ?"
-
 	var res ChairSearchResponse
-	err = dbChair.Get(&res.Count, countQuery+searchCondition, params...)
-	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	chairs := []Chair{}
-	params = append(params, perPage, page*perPage)
-	err = dbChair.Select(&chairs, searchQuery+searchCondition+limitOffset, params...)
+	res.Count, res.Chairs, err = s.chairs.SearchChairs(c.Request().Context(), q)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, ChairSearchResponse{Count: 0, Chairs: []Chair{}})
-		}
+		c.Logger().Errorf("searchChairs DB execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	res.Chairs = chairs
 	b, _ := json.Marshal(res)
 	return c.JSONBlob(http.StatusOK, b)
 }
 
-func buyChair(c echo.Context) error {
+func (s *server) buyChair(c echo.Context) error {
 	m := echo.Map{}
 	if err := c.Bind(&m); err != nil {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	_, ok := m["email"].(string)
-	if !ok {
+	email, ok := m["email"].(string)
+	if !ok || email == "" {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
@@ -619,31 +790,21 @@ func buyChair(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	tx, err := dbChair.Beginx()
-	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+	// 取り置きのトークンがあれば取り置いた在庫を買う
+	if token, _ := m["reservationToken"].(string); token != "" {
+		_, err = s.chairs.BuyReservedChair(c.Request().Context(), token, int64(id), email)
+	} else {
+		_, err = s.chairs.BuyChair(c.Request().Context(), int64(id), email)
 	}
-	defer tx.Rollback()
-
-	var chair Chair
-	err = tx.QueryRowx("SELECT id FROM chair WHERE id = ? AND stock > 0 FOR UPDATE", id).StructScan(&chair)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		switch err {
+		case ErrNotFound:
 			return c.NoContent(http.StatusNotFound)
+		case ErrInvalidReservation:
+			return c.JSON(http.StatusConflict, ErrorResponse{Message: err.Error()})
 		}
 
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	_, err = tx.Exec("UPDATE chair SET stock = stock - 1 WHERE id = ?", id)
-	if err != nil {
-
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	err = tx.Commit()
-	if err != nil {
-
+		c.Logger().Errorf("buyChair DB execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -654,15 +815,9 @@ func getChairSearchCondition(c echo.Context) error {
 	return c.JSON(http.StatusOK, chairSearchCondition)
 }
 
-func getLowPricedChair(c echo.Context) error {
-	var chairs []Chair
-	query := `SELECT id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock FROM chair  WHERE stock > 0 ORDER BY price ASC, id ASC LIMIT ?`
-	err := dbChair.Select(&chairs, query, Limit) // ここが遅い
+func (s *server) getLowPricedChair(c echo.Context) error {
+	chairs, err := s.chairs.LowPricedChairs(c.Request().Context(), Limit)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.Logger().Error("getLowPricedChair not found")
-			return c.JSON(http.StatusOK, ChairListResponse{[]Chair{}})
-		}
 		c.Logger().Errorf("getLowPricedChair DB execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
@@ -670,17 +825,16 @@ func getLowPricedChair(c echo.Context) error {
 	return c.JSON(http.StatusOK, ChairListResponse{Chairs: chairs})
 }
 
-func getEstateDetail(c echo.Context) error {
+func (s *server) getEstateDetail(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	var estate Estate
-	err = dbEstate.Get(&estate, "SELECT id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity FROM estate WHERE id = ? LIMIT 1", id)
+	estate, err := s.estates.GetEstate(c.Request().Context(), int64(id))
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == ErrNotFound {
 
 			return c.NoContent(http.StatusNotFound)
 		}
@@ -704,237 +858,316 @@ func getRange(cond RangeCondition, rangeID string) (*Range, error) {
 	return cond.Ranges[RangeIndex], nil
 }
 
-func postEstate(c echo.Context) error {
-	header, err := c.FormFile("estates")
+// getMinMax name+"Min" と name+"Max" で指定された値の範囲を返す。両端とも含み、指定がなければ -1 を返す
+// ranges が指定されている場合は範囲IDとの AND で絞り込むため、どの範囲とも重ならない指定はエラーにする
+func getMinMax(c echo.Context, name string, ranges []*Range) (int64, int64, error) {
+	min, err := getNonNegativeInt(c, name+"Min")
 	if err != nil {
-		c.Logger().Errorf("failed to get form file: %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return -1, -1, err
 	}
-	f, err := header.Open()
+	max, err := getNonNegativeInt(c, name+"Max")
 	if err != nil {
-		c.Logger().Errorf("failed to open form file: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return -1, -1, err
 	}
-	defer f.Close()
-	records, err := csv.NewReader(f).ReadAll()
-	if err != nil {
-		c.Logger().Errorf("failed to read csv: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	if min >= 0 && max >= 0 && min > max {
+		return -1, -1, fmt.Errorf("%vMin (%v) must not be greater than %vMax (%v)", name, min, name, max)
 	}
+	if len(ranges) == 0 || (min < 0 && max < 0) {
+		return min, max, nil
+	}
+	for _, r := range ranges {
+		if r.overlaps(min, max) {
+			return min, max, nil
+		}
+	}
+	return -1, -1, fmt.Errorf("%vMin/%vMax does not overlap any of the ranges given by %vRangeId", name, name, name)
+}
 
-	tx, err := dbEstate.Begin()
-	if err != nil {
-		c.Logger().Errorf("failed to begin tx: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+func getNonNegativeInt(c echo.Context, key string) (int64, error) {
+	s := c.QueryParam(key)
+	if s == "" {
+		return -1, nil
 	}
-	defer tx.Rollback()
-	query := &bytes.Buffer{}
-	values := make([]interface{}, 0, len(records)*12)
-	for _, row := range records {
-		rm := RecordMapper{Record: row}
-		id := rm.NextInt()
-		name := rm.NextString()
-		description := rm.NextString()
-		thumbnail := rm.NextString()
-		address := rm.NextString()
-		latitude := rm.NextFloat()
-		longitude := rm.NextFloat()
-		rent := rm.NextInt()
-		doorHeight := rm.NextInt()
-		doorWidth := rm.NextInt()
-		features := rm.NextString()
-		popularity := rm.NextInt()
-		doorWidthRange := getSizeId(doorWidth)
-		doorHeightRange := getSizeId(doorHeight)
-		rentRange := getRentPriceId(rent)
-		if err := rm.Err(); err != nil {
-			c.Logger().Errorf("failed to read record: %v", err)
-			return c.NoContent(http.StatusBadRequest)
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return -1, fmt.Errorf("%v must be a non-negative integer: %q", key, s)
+	}
+	return v, nil
+}
+
+// overlaps 両端を含む [min, max] と範囲が重なるかを判定する。範囲の Max は含まず、-1 は上限(下限)なしを表す
+func (r *Range) overlaps(min, max int64) bool {
+	if max >= 0 && r.Min >= 0 && max < r.Min {
+		return false
+	}
+	if min >= 0 && r.Max >= 0 && min >= r.Max {
+		return false
+	}
+	return true
+}
+
+// getRanges カンマ区切りで指定された複数の範囲IDを getRange で解釈する
+func getRanges(cond RangeCondition, rangeIDs string) ([]*Range, error) {
+	ranges := make([]*Range, 0)
+	for _, rangeID := range strings.Split(rangeIDs, ",") {
+		r, err := getRange(cond, rangeID)
+		if err != nil {
+			return nil, err
 		}
-		io.WriteString(query, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?),")
-		values = append(values, id, name, description, thumbnail, address, latitude, longitude, rent, doorHeight, doorWidth, features, popularity, doorWidthRange, doorHeightRange, rentRange)
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
 
+// getListValues カンマ区切りで指定された複数の値が cond の候補に含まれるかを確かめる
+func getListValues(cond ListCondition, values string) ([]string, error) {
+	list := strings.Split(values, ",")
+	for _, v := range list {
+		found := false
+		for _, candidate := range cond.List {
+			if v == candidate {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unexpected value %q", v)
+		}
 	}
-	valueStr := query.String()
-	if _, err := tx.Exec("INSERT INTO estate(id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity, door_width_range, door_height_range, rent_range) VALUES "+valueStr[:len(valueStr)-1], values...); err != nil {
-		c.Logger().Errorf("failed to insert estate: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	return list, nil
+}
+
+// inCondition column が n 個のプレースホルダのいずれかに一致する条件を作る
+func inCondition(column string, n int) string {
+	if n == 1 {
+		return column + " = ?"
 	}
-	if err := tx.Commit(); err != nil {
-		c.Logger().Errorf("failed to commit tx: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	return column + " IN (" + strings.TrimSuffix(strings.Repeat("?, ", n), ", ") + ")"
+}
+
+func rangeIDs(ranges []*Range) []int64 {
+	ids := make([]int64, 0, len(ranges))
+	for _, r := range ranges {
+		ids = append(ids, r.ID)
 	}
+	return ids
+}
 
-	recoMap.mu.Lock()
-	defer recoMap.mu.Unlock()
-	recoMap.rm = map[int][]Estate{}
+func appendStrings(params []interface{}, values []string) []interface{} {
+	for _, v := range values {
+		params = append(params, v)
+	}
+	return params
+}
 
-	//lpMap.mu.Lock()
-	//defer lpMap.mu.Unlock()
-	//lpMap.lp = nil
+// postEstate 有効な行を ChunkSize 件ずつ書き込み、アップロード全体をメモリに持たない
+// 問題のある行が見つかったら以降は書き込まずに検証だけを続け、最後にロールバックする
+func (s *server) postEstate(c echo.Context) error {
+	dryRun, err := getDryRun(c)
+	if err != nil {
+		return c.NoContent(http.StatusBadRequest)
+	}
+	mode, err := getImportMode(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+	}
+
+	ctx := c.Request().Context()
+	var importer EstateImporter
+	if !dryRun {
+		importer, err = s.estates.ImportEstates(ctx, mode)
+		if err != nil {
+			c.Logger().Errorf("failed to start importing estates: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		defer importer.Rollback()
+	}
+
+	report := newImportReport(mode, dryRun)
+	ids := idSet{}
+	inserted := newInsertedEstates(Limit)
+	batch := make([]Estate, 0, s.csvImport.ChunkSize)
+	var writeErr error
+	flush := func() {
+		if len(batch) > 0 && writeErr == nil && !report.failed() {
+			writeErr = importer.Write(ctx, batch)
+			if writeErr == nil && mode == ImportInsert {
+				inserted.add(batch)
+			}
+		}
+		batch = batch[:0]
+	}
+	// CSV でも NDJSON でも同じように検証して同じ経路で書き込む
+	err = s.csvImport.readEstates(c, func(line int, estate Estate, reasons []string) {
+		if len(reasons) == 0 {
+			reasons = ids.check(estate.ID, line)
+		}
+		report.add(line, reasons)
+		if len(reasons) == 0 && importer != nil {
+			batch = append(batch, estate)
+			if len(batch) >= s.csvImport.ChunkSize {
+				flush()
+			}
+		}
+	})
+	if err != nil {
+		return s.uploadReadError(c, report, err)
+	}
+	if importer != nil {
+		flush()
+	}
+	if writeErr != nil {
+		return s.importWriteError(c, report, ids, writeErr)
+	}
+	if report.failed() || dryRun {
+		return c.JSON(importReportStatus(report), report)
+	}
+	summary, err := importer.Commit(ctx)
+	if err != nil {
+		return s.importWriteError(c, report, ids, err)
+	}
+	report.Summary = &summary
+	if mode == ImportInsert {
+		s.applyInsertedEstates(inserted)
+	} else if summary.Inserted+summary.Updated+summary.Deleted > 0 {
+		// 更新や削除でキャッシュの物件が変わったり外れたりするので作り直す
+		s.lowPricedEstates.clear()
+		s.recommendedEstates.clear()
+	}
 
-	return c.NoContent(http.StatusCreated)
+	return c.JSON(importReportStatus(report), report)
 }
 
-func searchEstates(c echo.Context) error {
-	conditions := make([]string, 0)
-	params := make([]interface{}, 0)
+// parseEstateSearchQuery 物件の検索条件をクエリパラメータから読む。ページ指定は読まない
+func parseEstateSearchQuery(c echo.Context) (EstateSearchQuery, error) {
+	q := EstateSearchQuery{}
 
+	var doorHeights []*Range
 	if c.QueryParam("doorHeightRangeId") != "" {
-		doorHeight, err := getRange(estateSearchCondition.DoorHeight, c.QueryParam("doorHeightRangeId"))
+		var err error
+		doorHeights, err = getRanges(estateSearchCondition.DoorHeight, c.QueryParam("doorHeightRangeId"))
 		if err != nil {
-
-			return c.NoContent(http.StatusBadRequest)
+			return q, err
 		}
-		conditions = append(conditions, "door_height_range = ?")
-		params = append(params, doorHeight.ID)
+		q.DoorHeightRangeIDs = rangeIDs(doorHeights)
 	}
 
+	var doorWidths []*Range
 	if c.QueryParam("doorWidthRangeId") != "" {
-		doorWidth, err := getRange(estateSearchCondition.DoorWidth, c.QueryParam("doorWidthRangeId"))
+		var err error
+		doorWidths, err = getRanges(estateSearchCondition.DoorWidth, c.QueryParam("doorWidthRangeId"))
 		if err != nil {
-
-			return c.NoContent(http.StatusBadRequest)
+			return q, err
 		}
-
-		conditions = append(conditions, "door_width_range = ?")
-		params = append(params, doorWidth.ID)
+		q.DoorWidthRangeIDs = rangeIDs(doorWidths)
 	}
 
+	var estateRents []*Range
 	if c.QueryParam("rentRangeId") != "" {
-		estateRent, err := getRange(estateSearchCondition.Rent, c.QueryParam("rentRangeId"))
+		var err error
+		estateRents, err = getRanges(estateSearchCondition.Rent, c.QueryParam("rentRangeId"))
 		if err != nil {
-
-			return c.NoContent(http.StatusBadRequest)
+			return q, err
 		}
+		q.RentRangeIDs = rangeIDs(estateRents)
+	}
 
-		conditions = append(conditions, "rent_range = ?")
-		params = append(params, estateRent.ID)
+	minMaxFilters := []struct {
+		name   string
+		ranges []*Range
+		bounds *Bounds
+	}{
+		{name: "rent", ranges: estateRents, bounds: &q.Rent},
+		{name: "doorWidth", ranges: doorWidths, bounds: &q.DoorWidth},
+		{name: "doorHeight", ranges: doorHeights, bounds: &q.DoorHeight},
+	}
+	for _, f := range minMaxFilters {
+		min, max, err := getMinMax(c, f.name, f.ranges)
+		if err != nil {
+			c.Logger().Infof("Invalid %v filter : %v", f.name, err)
+			return q, &invalidFilterError{err: err}
+		}
+		*f.bounds = Bounds{Min: min, Max: max}
 	}
 
 	if c.QueryParam("features") != "" {
-		featureParams := strings.Split(c.QueryParam("features"), ",")
-		for _, f := range featureParams {
-			conditions = append(conditions, "features like concat('%', ?, '%')")
-			params = append(params, f)
-		}
-		if len(featureParams) > 1 {
-			time.Sleep(time.Millisecond * 500)
+		featureIDs, err := estateFeatureIDs.lookup(strings.Split(c.QueryParam("features"), ","))
+		if err != nil {
+			return q, err
 		}
+		q.FeaturesMask = featuresMask(featureIDs)
+	}
+
+	return q, nil
+}
+
+func (s *server) searchEstates(c echo.Context) error {
+	q, err := parseEstateSearchQuery(c)
+	if err != nil {
+		return searchQueryError(c, err)
 	}
 
-	if len(conditions) == 0 {
+	if q.empty() {
 
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	page, err := strconv.Atoi(c.QueryParam("page"))
+	q.Page, err = strconv.Atoi(c.QueryParam("page"))
 	if err != nil {
 		c.Logger().Infof("Invalid format page parameter : %v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	q.PerPage, err = strconv.Atoi(c.QueryParam("perPage"))
 	if err != nil {
 		c.Logger().Infof("Invalid format perPage parameter : %v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	searchQuery := "SELECT id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity FROM estate WHERE "
-	countQuery := "SELECT COUNT(id) FROM estate WHERE "
-	searchCondition := strings.Join(conditions, " AND ")
-	limitOffset := " ORDER BY popularity DESC, id ASC LIMIT ? OFFSET ?"
-
 	var res EstateSearchResponse
-	err = dbEstate.Get(&res.Count, countQuery+searchCondition, params...)
-	if err != nil {
-		c.Logger().Errorf("searchEstates DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	estates := []Estate{}
-	params = append(params, perPage, page*perPage)
-	err = dbEstate.Select(&estates, searchQuery+searchCondition+limitOffset, params...) // これが思い
+	res.Count, res.Estates, err = s.estates.SearchEstates(c.Request().Context(), q)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, EstateSearchResponse{Count: 0, Estates: []Estate{}})
-		}
 		c.Logger().Errorf("searchEstates DB execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	res.Estates = estates
-
 	b, _ := json.Marshal(res)
 	return c.JSONBlob(http.StatusOK, b)
 }
 
-//var lpMap = struct {
-//	lp []Estate
-//	mu sync.RWMutex
-//}{
-//	lp: nil,
-//	mu: sync.RWMutex{},
-//}
-
-func getLowPricedEstate(c echo.Context) error {
-	//lpMap.mu.RLock()
-	//
-	//if lpMap.lp != nil {
-	//	b, _ := json.Marshal(EstateListResponse{Estates: lpMap.lp})
-	//	lpMap.mu.RUnlock()
-	//	return c.JSONBlob(http.StatusOK, b)
-	//}
-	//lpMap.mu.RUnlock()
-
-	estates := make([]Estate, 0, Limit)
-	query := `SELECT id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity FROM estate ORDER BY rent ASC, id ASC LIMIT ?`
-	err := dbEstate.Select(&estates, query, Limit)
+func (s *server) getLowPricedEstate(c echo.Context) error {
+	estates, gen, ok := s.lowPricedEstates.get()
+	if ok {
+		b, _ := json.Marshal(EstateListResponse{Estates: estates})
+		return c.JSONBlob(http.StatusOK, b)
+	}
+
+	ctx := c.Request().Context()
+	if s.lowPricedEstates.refillFromPrimary() {
+		ctx = withPrimaryReads(ctx)
+	}
+	estates, err := s.estates.LowPricedEstates(ctx, Limit)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.Logger().Error("getLowPricedEstate not found")
-			return c.JSON(http.StatusOK, EstateListResponse{[]Estate{}})
-		}
 		c.Logger().Errorf("getLowPricedEstate DB execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-
-	//lpMap.mu.Lock()
-	//defer lpMap.mu.Unlock()
-	//lpMap.lp = estates
+	s.lowPricedEstates.set(estates, gen)
 
 	b, _ := json.Marshal(EstateListResponse{Estates: estates})
 	return c.JSONBlob(http.StatusOK, b)
 }
 
-var recoMap = struct {
-	rm map[int][]Estate
-	mu sync.RWMutex
-}{
-	rm: map[int][]Estate{},
-	mu: sync.RWMutex{},
-}
-
-func searchRecommendedEstateWithChair(c echo.Context) error {
+func (s *server) searchRecommendedEstateWithChair(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		c.Logger().Infof("Invalid format searchRecommendedEstateWithChair id : %v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	recoMap.mu.RLock()
-
-	if value, ok := recoMap.rm[id]; ok {
-		recoMap.mu.RUnlock()
-		return c.JSON(http.StatusOK, EstateListResponse{Estates: value})
-	}
-	recoMap.mu.RUnlock()
-
-	chair := Chair{}
-	query := `SELECT width,height,depth FROM chair WHERE id = ? LIMIT 1`
-	err = dbChair.Get(&chair, query, id)
+	ctx := c.Request().Context()
+	chair, err := s.chairs.GetChair(ctx, int64(id))
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == ErrNotFound {
 			c.Logger().Infof("Requested chair id \"%v\" not found", id)
 			return c.NoContent(http.StatusBadRequest)
 		}
@@ -942,28 +1175,26 @@ func searchRecommendedEstateWithChair(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	var estates []Estate
-	w := chair.Width
-	h := chair.Height
-	d := chair.Depth
-	query = `SELECT id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity FROM estate WHERE (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) ORDER BY popularity DESC, id ASC LIMIT ?`
-	err = dbEstate.Select(&estates, query, w, h, w, d, h, w, h, d, d, w, d, h, Limit)
+	shape := newChairShape(chair.Width, chair.Height, chair.Depth)
+	estates, gen, ok := s.recommendedEstates.get(shape)
+	if ok {
+		return c.JSON(http.StatusOK, EstateListResponse{Estates: estates})
+	}
+
+	if s.recommendedEstates.refillFromPrimary() {
+		ctx = withPrimaryReads(ctx)
+	}
+	estates, err = s.estates.RecommendedEstates(ctx, chair.Width, chair.Height, chair.Depth, Limit)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, EstateListResponse{[]Estate{}})
-		}
 		c.Logger().Errorf("Database execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	recoMap.mu.Lock()
-	defer recoMap.mu.Unlock()
-
-	recoMap.rm[id] = estates
+	s.recommendedEstates.set(shape, estates, gen)
 	return c.JSON(http.StatusOK, EstateListResponse{Estates: estates})
 }
 
-func searchEstateNazotte(c echo.Context) error {
+func (s *server) searchEstateNazotte(c echo.Context) error {
 	coordinates := Coordinates{}
 	err := c.Bind(&coordinates)
 	if err != nil {
@@ -975,61 +1206,28 @@ func searchEstateNazotte(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	b := coordinates.getBoundingBox()
-	estatesInBoundingBox := []Estate{}
-	query := `SELECT id, latitude,longitude FROM estate WHERE latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ? ORDER BY popularity DESC, id ASC`
-	err = dbEstate.Select(&estatesInBoundingBox, query, b.TopLeftCorner.Latitude, b.BottomRightCorner.Latitude, b.TopLeftCorner.Longitude, b.BottomRightCorner.Longitude)
-	if err == sql.ErrNoRows {
-
-		return c.JSON(http.StatusOK, EstateSearchResponse{Count: 0, Estates: []Estate{}})
-	} else if err != nil {
-
+	estatesInPolygon, err := s.estates.SearchEstatesInPolygon(c.Request().Context(), coordinates.toPolygon(), NazotteLimit)
+	if err != nil {
+		c.Logger().Errorf("searchEstateNazotte DB execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	estatesInPolygon := []Estate{}
-	for _, estate := range estatesInBoundingBox {
-		validatedEstate := Estate{}
-
-		point := fmt.Sprintf("'POINT(%f %f)'", estate.Latitude, estate.Longitude)
-		query := fmt.Sprintf(`SELECT id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity FROM estate WHERE id = ? AND ST_Contains(ST_PolygonFromText(%s), ST_GeomFromText(%s))`, coordinates.coordinatesToText(), point)
-		err = dbEstate.Get(&validatedEstate, query, estate.ID) // ここが遅い
-		if err != nil {
-			if err == sql.ErrNoRows {
-				continue
-			} else {
-
-				return c.NoContent(http.StatusInternalServerError)
-			}
-		} else {
-			estatesInPolygon = append(estatesInPolygon, validatedEstate)
-		}
-		if len(estatesInPolygon) > NazotteLimit {
-			break
-		}
-	}
-
 	var re EstateSearchResponse
-	re.Estates = []Estate{}
-	if len(estatesInPolygon) > NazotteLimit {
-		re.Estates = estatesInPolygon[:NazotteLimit]
-	} else {
-		re.Estates = estatesInPolygon
-	}
+	re.Estates = estatesInPolygon
 	re.Count = int64(len(re.Estates))
 
 	return c.JSON(http.StatusOK, re)
 }
 
-func postEstateRequestDocument(c echo.Context) error {
+func (s *server) postEstateRequestDocument(c echo.Context) error {
 	m := echo.Map{}
 	if err := c.Bind(&m); err != nil {
 
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	_, ok := m["email"].(string)
-	if !ok {
+	email, ok := m["email"].(string)
+	if !ok || email == "" {
 
 		return c.NoContent(http.StatusBadRequest)
 	}
@@ -1040,17 +1238,32 @@ func postEstateRequestDocument(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	estate := Estate{}
-	query := `SELECT id FROM estate WHERE id = ? LIMIT 1`
-	err = dbEstate.Get(&estate, query, id)
+	ctx := c.Request().Context()
+	estate, err := s.estates.GetEstate(ctx, int64(id))
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == ErrNotFound {
 			return c.NoContent(http.StatusNotFound)
 		}
 		c.Logger().Errorf("postEstateRequestDocument DB execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	req, err := s.estates.CreateDocumentRequest(ctx, estate.ID, email, time.Now().Add(-s.documentRequestInterval))
+	if err != nil {
+		switch err {
+		case ErrNotFound:
+			return c.NoContent(http.StatusNotFound)
+		case ErrDuplicateDocumentRequest:
+			return c.JSON(http.StatusTooManyRequests, ErrorResponse{Message: "document request already received"})
+		}
+		c.Logger().Errorf("postEstateRequestDocument DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 資料請求は記録済みなので、通知に失敗してもリクエストは成功として返す
+	if err := s.documentNotifier.Notify(ctx, req, estate); err != nil {
+		c.Logger().Errorf("failed to notify document request %v : %v", req.ID, err)
+	}
+
 	return c.NoContent(http.StatusOK)
 }
 
@@ -1058,38 +1271,10 @@ func getEstateSearchCondition(c echo.Context) error {
 	return c.JSON(http.StatusOK, estateSearchCondition)
 }
 
-func (cs Coordinates) getBoundingBox() BoundingBox {
-	coordinates := cs.Coordinates
-	boundingBox := BoundingBox{
-		TopLeftCorner: Coordinate{
-			Latitude: coordinates[0].Latitude, Longitude: coordinates[0].Longitude,
-		},
-		BottomRightCorner: Coordinate{
-			Latitude: coordinates[0].Latitude, Longitude: coordinates[0].Longitude,
-		},
-	}
-	for _, coordinate := range coordinates {
-		if boundingBox.TopLeftCorner.Latitude > coordinate.Latitude {
-			boundingBox.TopLeftCorner.Latitude = coordinate.Latitude
-		}
-		if boundingBox.TopLeftCorner.Longitude > coordinate.Longitude {
-			boundingBox.TopLeftCorner.Longitude = coordinate.Longitude
-		}
-
-		if boundingBox.BottomRightCorner.Latitude < coordinate.Latitude {
-			boundingBox.BottomRightCorner.Latitude = coordinate.Latitude
-		}
-		if boundingBox.BottomRightCorner.Longitude < coordinate.Longitude {
-			boundingBox.BottomRightCorner.Longitude = coordinate.Longitude
-		}
-	}
-	return boundingBox
-}
-
-func (cs Coordinates) coordinatesToText() string {
-	points := make([]string, 0, len(cs.Coordinates))
+func (cs Coordinates) toPolygon() spatial.Polygon {
+	polygon := make(spatial.Polygon, 0, len(cs.Coordinates))
 	for _, c := range cs.Coordinates {
-		points = append(points, fmt.Sprintf("%f %f", c.Latitude, c.Longitude))
+		polygon = append(polygon, spatial.Point{Latitude: c.Latitude, Longitude: c.Longitude})
 	}
-	return fmt.Sprintf("'POLYGON((%s))'", strings.Join(points, ","))
+	return polygon
 }
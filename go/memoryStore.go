@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon10-qualify/isuumo/spatial"
+)
+
+// memoryChairStore 椅子をメモリ上だけに保持する ChairStore
+type memoryChairStore struct {
+	mu     sync.RWMutex
+	chairs map[int64]*Chair
+	// orders 購入記録を古い順に持つ
+	orders []Order
+	// reservations トークンごとの取り置き
+	reservations map[string]Reservation
+}
+
+func newMemoryChairStore() *memoryChairStore {
+	return &memoryChairStore{chairs: map[int64]*Chair{}, reservations: map[string]Reservation{}}
+}
+
+func (s *memoryChairStore) Initialize(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.chairs = map[int64]*Chair{}
+	s.orders = nil
+	s.reservations = map[string]Reservation{}
+	return nil
+}
+
+func (s *memoryChairStore) GetChair(ctx context.Context, id int64) (*Chair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chair, ok := s.chairs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *chair
+	return &c, nil
+}
+
+// memoryChairImporter 書き込んだ椅子を溜めておき、Commit でまとめて反映する
+type memoryChairImporter struct {
+	s      *memoryChairStore
+	mode   ImportMode
+	staged []Chair
+	kept   map[int64]bool
+	// excess 在庫より多く取り置かれていたので、Commit で取り消す椅子ごとの取り置きの数
+	excess  map[int64]int64
+	summary ImportSummary
+}
+
+func (s *memoryChairStore) ImportChairs(ctx context.Context, mode ImportMode) (ChairImporter, error) {
+	return &memoryChairImporter{s: s, mode: mode, kept: map[int64]bool{}, excess: map[int64]int64{}}, nil
+}
+
+func (i *memoryChairImporter) Write(ctx context.Context, chairs []Chair) error {
+	i.s.mu.RLock()
+	existing := make(map[int64]Chair, len(chairs))
+	for _, chair := range chairs {
+		if old, ok := i.s.chairs[chair.ID]; ok {
+			existing[chair.ID] = *old
+		}
+	}
+	reserved := make(map[int64]int64)
+	for _, r := range i.s.reservations {
+		if _, ok := existing[r.ChairID]; ok {
+			reserved[r.ChairID]++
+		}
+	}
+	i.s.mu.RUnlock()
+
+	chairs, excess := subtractReservations(chairs, reserved)
+	plan, err := planChairImport(chairs, existing, i.mode)
+	if err != nil {
+		return err
+	}
+	for id, n := range excess {
+		i.excess[id] = n
+	}
+	i.staged = append(i.staged, plan.inserted...)
+	i.staged = append(i.staged, plan.updated...)
+	for _, chair := range chairs {
+		i.kept[chair.ID] = true
+	}
+	i.summary.add(plan.summary)
+	return nil
+}
+
+func (i *memoryChairImporter) Commit(ctx context.Context) (ImportSummary, error) {
+	s := i.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for j := range i.staged {
+		chair := i.staged[j]
+		s.chairs[chair.ID] = &chair
+	}
+	for id, n := range i.excess {
+		s.cancelReservations(id, n)
+	}
+	if i.mode == ImportReplace {
+		existing := make([]int64, 0, len(s.chairs))
+		for id := range s.chairs {
+			existing = append(existing, id)
+		}
+		deleted := missingIDs(existing, i.kept)
+		for _, id := range deleted {
+			delete(s.chairs, id)
+			for token, r := range s.reservations {
+				if r.ChairID == id {
+					delete(s.reservations, token)
+				}
+			}
+		}
+		i.summary.Deleted = len(deleted)
+	}
+	return i.summary, nil
+}
+
+// cancelReservations 椅子 id の取り置きを期限の遅いものから n 件取り消す。s.mu を取った状態で呼ぶ
+func (s *memoryChairStore) cancelReservations(id int64, n int64) {
+	reservations := make([]Reservation, 0)
+	for _, r := range s.reservations {
+		if r.ChairID == id {
+			reservations = append(reservations, r)
+		}
+	}
+	sort.Slice(reservations, func(i, j int) bool { return reservations[i].ExpiresAt.After(reservations[j].ExpiresAt) })
+	for j := 0; j < len(reservations) && int64(j) < n; j++ {
+		delete(s.reservations, reservations[j].Token)
+	}
+}
+
+// Rollback 溜めた書き込みを捨てる。Commit の後なら反映済みなので何も変わらない
+func (i *memoryChairImporter) Rollback() error {
+	i.staged = nil
+	return nil
+}
+
+func (s *memoryChairStore) ExportChairs(ctx context.Context, q ChairSearchQuery, fn func(Chair) error) error {
+	s.mu.RLock()
+	found := make([]Chair, 0)
+	for _, chair := range s.chairs {
+		if q.matchFilters(chair) {
+			found = append(found, *chair)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(found, func(i, j int) bool { return found[i].ID < found[j].ID })
+	for _, chair := range found {
+		if err := fn(chair); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryChairStore) SearchChairs(ctx context.Context, q ChairSearchQuery) (int64, []Chair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := make([]Chair, 0)
+	for _, chair := range s.chairs {
+		if q.match(chair) {
+			found = append(found, *chair)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Popularity != found[j].Popularity {
+			return found[i].Popularity > found[j].Popularity
+		}
+		return found[i].ID < found[j].ID
+	})
+	from, to := pageRange(len(found), q.Page, q.PerPage)
+	return int64(len(found)), found[from:to], nil
+}
+
+func (s *memoryChairStore) LowPricedChairs(ctx context.Context, limit int) ([]Chair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chairs := make([]Chair, 0)
+	for _, chair := range s.chairs {
+		if chair.Stock > 0 {
+			chairs = append(chairs, *chair)
+		}
+	}
+	sort.Slice(chairs, func(i, j int) bool {
+		if chairs[i].Price != chairs[j].Price {
+			return chairs[i].Price < chairs[j].Price
+		}
+		return chairs[i].ID < chairs[j].ID
+	})
+	if len(chairs) > limit {
+		chairs = chairs[:limit]
+	}
+	return chairs, nil
+}
+
+func (s *memoryChairStore) BuyChair(ctx context.Context, id int64, email string) (*Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chair, ok := s.chairs[id]
+	if !ok || chair.Stock <= 0 {
+		return nil, ErrNotFound
+	}
+	chair.Stock--
+	order := Order{ID: int64(len(s.orders)) + 1, ChairID: id, Email: email, Price: chair.Price, Quantity: 1, CreatedAt: dbTime()}
+	s.orders = append(s.orders, order)
+	return &order, nil
+}
+
+func (s *memoryChairStore) ReserveChair(ctx context.Context, r Reservation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chair, ok := s.chairs[r.ChairID]
+	if !ok || chair.Stock <= 0 {
+		return ErrNotFound
+	}
+	chair.Stock--
+	s.reservations[r.Token] = r
+	return nil
+}
+
+func (s *memoryChairStore) BuyReservedChair(ctx context.Context, token string, id int64, email string) (*Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chair, ok := s.chairs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	r, ok := s.reservations[token]
+	if !ok || r.ChairID != id || !time.Now().Before(r.ExpiresAt) {
+		return nil, ErrInvalidReservation
+	}
+	delete(s.reservations, token)
+	order := Order{ID: int64(len(s.orders)) + 1, ChairID: id, Email: email, Price: chair.Price, Quantity: 1, CreatedAt: dbTime()}
+	s.orders = append(s.orders, order)
+	return &order, nil
+}
+
+func (s *memoryChairStore) ReleaseExpiredReservations(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for token, r := range s.reservations {
+		if now.Before(r.ExpiresAt) {
+			continue
+		}
+		if chair, ok := s.chairs[r.ChairID]; ok {
+			chair.Stock++
+		}
+		delete(s.reservations, token)
+		n++
+	}
+	return n, nil
+}
+
+func (s *memoryChairStore) Checkout(ctx context.Context, email string, cart []CartItem) ([]Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stocks := make(map[int64]int64, len(cart))
+	for _, item := range cart {
+		if chair, ok := s.chairs[item.ChairID]; ok {
+			stocks[chair.ID] = chair.Stock
+		}
+	}
+	if short := shortages(cart, stocks); len(short) > 0 {
+		return nil, &InsufficientStockError{Items: short}
+	}
+
+	now := dbTime()
+	orders := make([]Order, 0, len(cart))
+	for _, item := range cart {
+		chair := s.chairs[item.ChairID]
+		chair.Stock -= item.Quantity
+		order := Order{ID: int64(len(s.orders)) + 1, ChairID: chair.ID, Email: email, Price: chair.Price, Quantity: item.Quantity, CreatedAt: now}
+		s.orders = append(s.orders, order)
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+func (s *memoryChairStore) OrdersByEmail(ctx context.Context, email string, page, perPage int) (int64, []Order, error) {
+	return s.filterOrders(func(o *Order) bool { return o.Email == email }, page, perPage)
+}
+
+func (s *memoryChairStore) OrdersByChair(ctx context.Context, chairID int64, page, perPage int) (int64, []Order, error) {
+	return s.filterOrders(func(o *Order) bool { return o.ChairID == chairID }, page, perPage)
+}
+
+func (s *memoryChairStore) filterOrders(match func(*Order) bool, page, perPage int) (int64, []Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := make([]Order, 0)
+	for i := len(s.orders) - 1; i >= 0; i-- {
+		if match(&s.orders[i]) {
+			found = append(found, s.orders[i])
+		}
+	}
+	from, to := pageRange(len(found), page, perPage)
+	return int64(len(found)), found[from:to], nil
+}
+
+// memoryEstateStore 物件をメモリ上だけに保持する EstateStore
+type memoryEstateStore struct {
+	mu      sync.RWMutex
+	estates map[int64]*Estate
+	// requests 資料請求を古い順に持つ
+	requests []DocumentRequest
+}
+
+func newMemoryEstateStore() *memoryEstateStore {
+	return &memoryEstateStore{estates: map[int64]*Estate{}}
+}
+
+func (s *memoryEstateStore) Initialize(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.estates = map[int64]*Estate{}
+	s.requests = nil
+	return nil
+}
+
+func (s *memoryEstateStore) GetEstate(ctx context.Context, id int64) (*Estate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	estate, ok := s.estates[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	e := *estate
+	return &e, nil
+}
+
+// memoryEstateImporter 書き込んだ物件を溜めておき、Commit でまとめて反映する
+type memoryEstateImporter struct {
+	s       *memoryEstateStore
+	mode    ImportMode
+	staged  []Estate
+	kept    map[int64]bool
+	summary ImportSummary
+}
+
+func (s *memoryEstateStore) ImportEstates(ctx context.Context, mode ImportMode) (EstateImporter, error) {
+	return &memoryEstateImporter{s: s, mode: mode, kept: map[int64]bool{}}, nil
+}
+
+func (i *memoryEstateImporter) Write(ctx context.Context, estates []Estate) error {
+	i.s.mu.RLock()
+	existing := make(map[int64]Estate, len(estates))
+	for _, estate := range estates {
+		if old, ok := i.s.estates[estate.ID]; ok {
+			existing[estate.ID] = *old
+		}
+	}
+	i.s.mu.RUnlock()
+
+	plan, err := planEstateImport(estates, existing, i.mode)
+	if err != nil {
+		return err
+	}
+	i.staged = append(i.staged, plan.changed()...)
+	for _, estate := range estates {
+		i.kept[estate.ID] = true
+	}
+	i.summary.add(plan.summary)
+	return nil
+}
+
+func (i *memoryEstateImporter) Commit(ctx context.Context) (ImportSummary, error) {
+	s := i.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for j := range i.staged {
+		estate := i.staged[j]
+		s.estates[estate.ID] = &estate
+	}
+	if i.mode == ImportReplace {
+		existing := make([]int64, 0, len(s.estates))
+		for id := range s.estates {
+			existing = append(existing, id)
+		}
+		deleted := missingIDs(existing, i.kept)
+		for _, id := range deleted {
+			delete(s.estates, id)
+		}
+		i.summary.Deleted = len(deleted)
+	}
+	return i.summary, nil
+}
+
+// Rollback 溜めた書き込みを捨てる。Commit の後なら反映済みなので何も変わらない
+func (i *memoryEstateImporter) Rollback() error {
+	i.staged = nil
+	return nil
+}
+
+// filter match に合う物件を popularity DESC, id ASC で返す
+func (s *memoryEstateStore) filter(match func(*Estate) bool) []Estate {
+	found := make([]Estate, 0)
+	for _, estate := range s.estates {
+		if match(estate) {
+			found = append(found, *estate)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Popularity != found[j].Popularity {
+			return found[i].Popularity > found[j].Popularity
+		}
+		return found[i].ID < found[j].ID
+	})
+	return found
+}
+
+func (s *memoryEstateStore) ExportEstates(ctx context.Context, q EstateSearchQuery, fn func(Estate) error) error {
+	s.mu.RLock()
+	found := s.filter(q.match)
+	s.mu.RUnlock()
+
+	sort.Slice(found, func(i, j int) bool { return found[i].ID < found[j].ID })
+	for _, estate := range found {
+		if err := fn(estate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryEstateStore) SearchEstates(ctx context.Context, q EstateSearchQuery) (int64, []Estate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := s.filter(q.match)
+	from, to := pageRange(len(found), q.Page, q.PerPage)
+	return int64(len(found)), found[from:to], nil
+}
+
+func (s *memoryEstateStore) LowPricedEstates(ctx context.Context, limit int) ([]Estate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	estates := make([]Estate, 0, len(s.estates))
+	for _, estate := range s.estates {
+		estates = append(estates, *estate)
+	}
+	sort.Slice(estates, func(i, j int) bool {
+		if estates[i].Rent != estates[j].Rent {
+			return estates[i].Rent < estates[j].Rent
+		}
+		return estates[i].ID < estates[j].ID
+	})
+	if len(estates) > limit {
+		estates = estates[:limit]
+	}
+	return estates, nil
+}
+
+func (s *memoryEstateStore) RecommendedEstates(ctx context.Context, w, h, d int64, limit int) ([]Estate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := s.filter(func(e *Estate) bool { return e.fitsChair(w, h, d) })
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found, nil
+}
+
+func (s *memoryEstateStore) SearchEstatesInPolygon(ctx context.Context, polygon spatial.Polygon, limit int) ([]Estate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := s.filter(func(e *Estate) bool { return polygon.Contains(e.indexItem().Point) })
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found, nil
+}
+
+func (s *memoryEstateStore) CreateDocumentRequest(ctx context.Context, estateID int64, email string, since time.Time) (*DocumentRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.estates[estateID]; !ok {
+		return nil, ErrNotFound
+	}
+	for _, r := range s.requests {
+		if r.EstateID == estateID && r.Email == email && !r.CreatedAt.Before(since) {
+			return nil, ErrDuplicateDocumentRequest
+		}
+	}
+	now := dbTime()
+	req := DocumentRequest{ID: int64(len(s.requests)) + 1, EstateID: estateID, Email: email, Status: DocumentRequestPending, CreatedAt: now, UpdatedAt: now}
+	s.requests = append(s.requests, req)
+	return &req, nil
+}
+
+func (s *memoryEstateStore) DocumentRequests(ctx context.Context, q DocumentRequestQuery) (int64, []DocumentRequest, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := make([]DocumentRequest, 0)
+	for i := len(s.requests) - 1; i >= 0; i-- {
+		if q.match(&s.requests[i]) {
+			found = append(found, s.requests[i])
+		}
+	}
+	from, to := pageRange(len(found), q.Page, q.PerPage)
+	return int64(len(found)), found[from:to], nil
+}
+
+func (s *memoryEstateStore) UpdateDocumentRequestStatus(ctx context.Context, id int64, status string) (*DocumentRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id <= 0 || id > int64(len(s.requests)) {
+		return nil, ErrNotFound
+	}
+	req := &s.requests[id-1]
+	if !canTransition(req.Status, status) {
+		return nil, ErrInvalidStatusTransition
+	}
+	req.Status, req.UpdatedAt = status, dbTime()
+	r := *req
+	return &r, nil
+}
+
+// pageRange 全 n 件のうち page ページ目 (0 始まり) に当たる添字の範囲を返す
+func pageRange(n, page, perPage int) (int, int) {
+	from := page * perPage
+	if from < 0 || from >= n || perPage <= 0 {
+		return 0, 0
+	}
+	to := from + perPage
+	if to > n {
+		to = n
+	}
+	return from, to
+}
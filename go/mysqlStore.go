@@ -0,0 +1,985 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/isucon/isucon10-qualify/isuumo/spatial"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+const chairColumns = "id, name, description, thumbnail, price, height, width, depth, color, features, features_mask, kind, popularity, stock"
+const estateColumns = "id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, features_mask, popularity"
+const orderColumns = "id, chair_id, email, price, quantity, created_at"
+const reservationColumns = "token, chair_id, expires_at"
+const documentRequestColumns = "id, estate_id, email, status, created_at, updated_at"
+
+var sqlDir = filepath.Join("..", "mysql", "db")
+
+// sqlScriptDBName sqlDir のスクリプトが作るデータベースの名前。スクリプトに書かれているので変えられない
+const sqlScriptDBName = "isuumo"
+
+// chairSQLScripts, estateSQLScripts, sharedSQLScripts /initialize で流すスクリプト
+// 0_Schema.sql はデータベースを作り直すので、椅子と物件が同じデータベースを使うときは sharedSQLScripts を一度だけ流す
+var (
+	chairSQLScripts  = sqlScripts("0_Schema.sql", "2_DummyChairData.sql", "3_AddRange.sql", "4_FeatureTags.sql")
+	estateSQLScripts = sqlScripts("0_Schema.sql", "1_DummyEstateData.sql", "3_AddRange.sql", "4_FeatureTags.sql")
+	sharedSQLScripts = sqlScripts("0_Schema.sql", "1_DummyEstateData.sql", "2_DummyChairData.sql", "3_AddRange.sql", "4_FeatureTags.sql")
+)
+
+func sqlScripts(names ...string) []string {
+	paths := make([]string, 0, len(names))
+	for _, name := range names {
+		paths = append(paths, filepath.Join(sqlDir, name))
+	}
+	return paths
+}
+
+// notFound sql.ErrNoRows を ErrNotFound に読み替える
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+type mysqlChairStore struct {
+	db     *dbRouter
+	logger echo.Logger
+	// chunkSize 一つの INSERT 文で挿入する行数
+	chunkSize int
+	// scripts Initialize で流すスクリプト
+	scripts []string
+}
+
+func newMySQLChairStore(db *dbRouter, logger echo.Logger, chunkSize int) *mysqlChairStore {
+	return &mysqlChairStore{db: db, logger: logger, chunkSize: chunkSize, scripts: chairSQLScripts}
+}
+
+func (s *mysqlChairStore) Initialize(ctx context.Context) error {
+	return runSQLScripts(ctx, s.db.writer(ctx), s.logger, s.scripts)
+}
+
+func (s *mysqlChairStore) GetChair(ctx context.Context, id int64) (*Chair, error) {
+	chair := Chair{}
+	query := `SELECT ` + chairColumns + ` FROM chair WHERE id = ? LIMIT 1`
+	if err := s.db.reader(ctx).GetContext(ctx, &chair, query, id); err != nil {
+		return nil, notFound(err)
+	}
+	return &chair, nil
+}
+
+func (s *mysqlChairStore) selectAll(ctx context.Context) ([]Chair, error) {
+	chairs := []Chair{}
+	err := s.db.primary.SelectContext(ctx, &chairs, `SELECT `+chairColumns+` FROM chair`)
+	return chairs, err
+}
+
+// chairInsertHead chair に一行ずつ値を渡して書き込む INSERT / REPLACE 文の列。*_range は chairRows で計算する
+const chairInsertHead = "chair(id, name, description, thumbnail, price, height, width, depth, color, features, features_mask, kind, popularity, stock, height_range, width_range, depth_range, price_range)"
+
+// chairRows chairs を chairInsertHead の順の値にする
+func chairRows(chairs []Chair) []interface{} {
+	values := make([]interface{}, 0, len(chairs)*18)
+	for _, chair := range chairs {
+		heightRange := getSizeId(int(chair.Height))
+		widthRange := getSizeId(int(chair.Width))
+		depthRange := getSizeId(int(chair.Depth))
+		priceRange := getChairPriceId(int(chair.Price))
+		values = append(values, chair.ID, chair.Name, chair.Description, chair.Thumbnail, chair.Price, chair.Height, chair.Width, chair.Depth, chair.Color, chair.Features, chair.FeaturesMask, chair.Kind, chair.Popularity, chair.Stock, heightRange, widthRange, depthRange, priceRange)
+	}
+	return values
+}
+
+// lockChairs chairs のうち既にある椅子を FOR UPDATE で読む
+func (s *mysqlChairStore) lockChairs(ctx context.Context, tx *sqlx.Tx, chairs []Chair) (map[int64]Chair, error) {
+	ids := make([]int64, 0, len(chairs))
+	for _, chair := range chairs {
+		ids = append(ids, chair.ID)
+	}
+	existing := make(map[int64]Chair, len(chairs))
+	err := forEachChunk(ids, s.chunkSize, func(ids []int64) error {
+		query, params, err := sqlx.In("SELECT "+chairColumns+" FROM chair WHERE id IN (?) ORDER BY id FOR UPDATE", ids)
+		if err != nil {
+			return err
+		}
+		found := []Chair{}
+		if err := tx.SelectContext(ctx, &found, query, params...); err != nil {
+			return err
+		}
+		for _, chair := range found {
+			existing[chair.ID] = chair
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// countReservations existing の椅子ごとに取り置きの数を数える
+func (s *mysqlChairStore) countReservations(ctx context.Context, tx *sqlx.Tx, existing map[int64]Chair) (map[int64]int64, error) {
+	ids := make([]int64, 0, len(existing))
+	for id := range existing {
+		ids = append(ids, id)
+	}
+	reserved := make(map[int64]int64)
+	err := forEachChunk(ids, s.chunkSize, func(ids []int64) error {
+		query, params, err := sqlx.In("SELECT chair_id, COUNT(*) AS count FROM chair_reservation WHERE chair_id IN (?) GROUP BY chair_id", ids)
+		if err != nil {
+			return err
+		}
+		counts := []struct {
+			ChairID int64 `db:"chair_id"`
+			Count   int64 `db:"count"`
+		}{}
+		if err := tx.SelectContext(ctx, &counts, query, params...); err != nil {
+			return err
+		}
+		for _, c := range counts {
+			reserved[c.ChairID] = c.Count
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reserved, nil
+}
+
+// mysqlChairImporter 取り込みの間一つのトランザクションを開いておき、Write のたびに書き込む
+type mysqlChairImporter struct {
+	s    *mysqlChairStore
+	tx   *sqlx.Tx
+	mode ImportMode
+	// kept replace モードで書き込んだ椅子の ID。Commit でこれ以外を削除する
+	kept    map[int64]bool
+	summary ImportSummary
+}
+
+func (s *mysqlChairStore) ImportChairs(ctx context.Context, mode ImportMode) (ChairImporter, error) {
+	tx, err := s.db.writer(ctx).BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &mysqlChairImporter{s: s, tx: tx, mode: mode, kept: map[int64]bool{}}, nil
+}
+
+func (i *mysqlChairImporter) Write(ctx context.Context, chairs []Chair) error {
+	existing, err := i.s.lockChairs(ctx, i.tx, chairs)
+	if err != nil {
+		return err
+	}
+	// 取り置きは椅子をロックしてから入れるので、ここで数えた後に増えることはない
+	reserved, err := i.s.countReservations(ctx, i.tx, existing)
+	if err != nil {
+		return err
+	}
+	chairs, excess := subtractReservations(chairs, reserved)
+	plan, err := planChairImport(chairs, existing, i.mode)
+	if err != nil {
+		return err
+	}
+	for id, n := range excess {
+		if _, err := i.tx.ExecContext(ctx, "DELETE FROM chair_reservation WHERE chair_id = ? ORDER BY expires_at DESC LIMIT ?", id, n); err != nil {
+			return err
+		}
+	}
+
+	// max_allowed_packet やプレースホルダの上限を超えないよう chunkSize 行ずつ書き込む
+	if err := insertChunked(ctx, i.tx, "INSERT INTO "+chairInsertHead, 18, chairRows(plan.inserted), i.s.chunkSize); err != nil {
+		return err
+	}
+	if len(plan.updated) > 0 {
+		// REPLACE で行ごと置き換えて *_range も計算し直す
+		if err := insertChunked(ctx, i.tx, "REPLACE INTO "+chairInsertHead, 18, chairRows(plan.updated), i.s.chunkSize); err != nil {
+			return err
+		}
+	}
+	if i.mode == ImportReplace {
+		for _, chair := range chairs {
+			i.kept[chair.ID] = true
+		}
+	}
+	i.summary.add(plan.summary)
+	return nil
+}
+
+func (i *mysqlChairImporter) Commit(ctx context.Context) (ImportSummary, error) {
+	if i.mode == ImportReplace {
+		// 取り込みの間に追加された椅子もアップロードに含まれなければ消すので、最後に全ての椅子を FOR UPDATE で読む
+		existing := []int64{}
+		if err := i.tx.SelectContext(ctx, &existing, "SELECT id FROM chair ORDER BY id FOR UPDATE"); err != nil {
+			return ImportSummary{}, err
+		}
+		deleted := missingIDs(existing, i.kept)
+		for _, query := range []string{
+			"DELETE FROM chair WHERE id IN (?)",
+			"DELETE FROM chair_reservation WHERE chair_id IN (?)",
+		} {
+			if err := execInChunked(ctx, i.tx, query, deleted, i.s.chunkSize); err != nil {
+				return ImportSummary{}, err
+			}
+		}
+		i.summary.Deleted = len(deleted)
+	}
+	if err := i.tx.Commit(); err != nil {
+		return ImportSummary{}, err
+	}
+	return i.summary, nil
+}
+
+func (i *mysqlChairImporter) Rollback() error {
+	if err := i.tx.Rollback(); err != nil && err != sql.ErrTxDone {
+		return err
+	}
+	return nil
+}
+
+// chairConditions 検索条件を WHERE 句の条件とパラメータにする。在庫の条件は含めない
+func chairConditions(q ChairSearchQuery) ([]string, []interface{}) {
+	conditions := make([]string, 0)
+	params := make([]interface{}, 0)
+
+	if len(q.PriceRangeIDs) > 0 {
+		conditions = append(conditions, inCondition("price_range", len(q.PriceRangeIDs)))
+		params = appendInt64s(params, q.PriceRangeIDs)
+	}
+	if len(q.HeightRangeIDs) > 0 {
+		conditions = append(conditions, inCondition("height_range", len(q.HeightRangeIDs)))
+		params = appendInt64s(params, q.HeightRangeIDs)
+	}
+	if len(q.WidthRangeIDs) > 0 {
+		conditions = append(conditions, inCondition("width_range", len(q.WidthRangeIDs)))
+		params = appendInt64s(params, q.WidthRangeIDs)
+	}
+	if len(q.DepthRangeIDs) > 0 {
+		conditions = append(conditions, inCondition("depth_range", len(q.DepthRangeIDs)))
+		params = appendInt64s(params, q.DepthRangeIDs)
+	}
+	if len(q.Kinds) > 0 {
+		conditions = append(conditions, inCondition("kind", len(q.Kinds)))
+		params = appendStrings(params, q.Kinds)
+	}
+	if len(q.Colors) > 0 {
+		conditions = append(conditions, inCondition("color", len(q.Colors)))
+		params = appendStrings(params, q.Colors)
+	}
+	if q.FeaturesMask != 0 {
+		conditions = append(conditions, "features_mask & ? = ?")
+		params = append(params, q.FeaturesMask, q.FeaturesMask)
+	}
+	return conditions, params
+}
+
+// ExportChairs 結果を一度に持たないよう、行を読みながら fn に渡す
+func (s *mysqlChairStore) ExportChairs(ctx context.Context, q ChairSearchQuery, fn func(Chair) error) error {
+	conditions, params := chairConditions(q)
+	conditions = append(conditions, "TRUE")
+	query := "SELECT " + chairColumns + " FROM chair WHERE " + strings.Join(conditions, " AND ") + " ORDER BY id ASC"
+	rows, err := s.db.reader(ctx).QueryxContext(ctx, query, params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var chair Chair
+		if err := rows.StructScan(&chair); err != nil {
+			return err
+		}
+		if err := fn(chair); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *mysqlChairStore) SearchChairs(ctx context.Context, q ChairSearchQuery) (int64, []Chair, error) {
+	conditions, params := chairConditions(q)
+	conditions = append(conditions, "stock > 0")
+
+	searchQuery := "SELECT " + chairColumns + " FROM chair WHERE "
+	countQuery := "SELECT COUNT(id) FROM chair WHERE "
+	searchCondition := strings.Join(conditions, " AND ")
+	limitOffset := " ORDER BY popularity DESC, id ASC LIMIT ? OFFSET ?"
+
+	db := s.db.reader(ctx)
+	var count int64
+	if err := db.GetContext(ctx, &count, countQuery+searchCondition, params...); err != nil {
+		return 0, nil, err
+	}
+
+	chairs := []Chair{}
+	params = append(params, q.PerPage, q.Page*q.PerPage)
+	if err := db.SelectContext(ctx, &chairs, searchQuery+searchCondition+limitOffset, params...); err != nil {
+		return 0, nil, err
+	}
+	return count, chairs, nil
+}
+
+func (s *mysqlChairStore) LowPricedChairs(ctx context.Context, limit int) ([]Chair, error) {
+	chairs := []Chair{}
+	query := `SELECT ` + chairColumns + ` FROM chair WHERE stock > 0 ORDER BY price ASC, id ASC LIMIT ?`
+	err := s.db.reader(ctx).SelectContext(ctx, &chairs, query, limit) // ここが遅い
+	return chairs, err
+}
+
+func (s *mysqlChairStore) BuyChair(ctx context.Context, id int64, email string) (*Order, error) {
+	tx, err := s.db.writer(ctx).BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var chair Chair
+	err = tx.QueryRowxContext(ctx, "SELECT id, price FROM chair WHERE id = ? AND stock > 0 FOR UPDATE", id).StructScan(&chair)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE chair SET stock = stock - 1 WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+
+	order := Order{ChairID: id, Email: email, Price: chair.Price, Quantity: 1, CreatedAt: dbTime()}
+	if err := insertOrder(ctx, tx, &order); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// insertOrder 購入記録を追加し、採番された ID を order に入れる
+func insertOrder(ctx context.Context, tx *sqlx.Tx, order *Order) error {
+	res, err := tx.ExecContext(ctx, "INSERT INTO orders(chair_id, email, price, quantity, created_at) VALUES (?, ?, ?, ?, ?)", order.ChairID, order.Email, order.Price, order.Quantity, order.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert order: %w", err)
+	}
+	order.ID, err = res.LastInsertId()
+	return err
+}
+
+func (s *mysqlChairStore) Checkout(ctx context.Context, email string, cart []CartItem) ([]Order, error) {
+	tx, err := s.db.writer(ctx).BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids := make([]int64, 0, len(cart))
+	for _, item := range cart {
+		ids = append(ids, item.ChairID)
+	}
+	// 主キーの昇順で読むので、行ロックも常に id の昇順で取られる
+	query, params, err := sqlx.In("SELECT id, price, stock FROM chair WHERE id IN (?) ORDER BY id FOR UPDATE", ids)
+	if err != nil {
+		return nil, err
+	}
+	chairs := []Chair{}
+	if err := tx.SelectContext(ctx, &chairs, query, params...); err != nil {
+		return nil, err
+	}
+	stocks := make(map[int64]int64, len(chairs))
+	prices := make(map[int64]int64, len(chairs))
+	for _, chair := range chairs {
+		stocks[chair.ID] = chair.Stock
+		prices[chair.ID] = chair.Price
+	}
+	if short := shortages(cart, stocks); len(short) > 0 {
+		return nil, &InsufficientStockError{Items: short}
+	}
+
+	now := dbTime()
+	orders := make([]Order, 0, len(cart))
+	for _, item := range cart {
+		if _, err := tx.ExecContext(ctx, "UPDATE chair SET stock = stock - ? WHERE id = ?", item.Quantity, item.ChairID); err != nil {
+			return nil, err
+		}
+		order := Order{ChairID: item.ChairID, Email: email, Price: prices[item.ChairID], Quantity: item.Quantity, CreatedAt: now}
+		if err := insertOrder(ctx, tx, &order); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func (s *mysqlChairStore) ReserveChair(ctx context.Context, r Reservation) error {
+	tx, err := s.db.writer(ctx).BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	if err := tx.GetContext(ctx, &id, "SELECT id FROM chair WHERE id = ? AND stock > 0 FOR UPDATE", r.ChairID); err != nil {
+		return notFound(err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE chair SET stock = stock - 1 WHERE id = ?", r.ChairID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO chair_reservation(token, chair_id, expires_at) VALUES (?, ?, ?)", r.Token, r.ChairID, r.ExpiresAt); err != nil {
+		return fmt.Errorf("failed to insert chair_reservation: %w", err)
+	}
+	return tx.Commit()
+}
+
+// BuyReservedChair 取り置いた時点で在庫は減らしているので、取り置きを消して購入記録を残す
+// ロックは他の書き込みと同じく chair, chair_reservation の順に取る
+func (s *mysqlChairStore) BuyReservedChair(ctx context.Context, token string, id int64, email string) (*Order, error) {
+	tx, err := s.db.writer(ctx).BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var chair Chair
+	if err := tx.GetContext(ctx, &chair, "SELECT id, price FROM chair WHERE id = ? FOR UPDATE", id); err != nil {
+		return nil, notFound(err)
+	}
+	var r Reservation
+	if err := tx.GetContext(ctx, &r, "SELECT "+reservationColumns+" FROM chair_reservation WHERE token = ? FOR UPDATE", token); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidReservation
+		}
+		return nil, err
+	}
+	if r.ChairID != id || !time.Now().Before(r.ExpiresAt) {
+		return nil, ErrInvalidReservation
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chair_reservation WHERE token = ?", token); err != nil {
+		return nil, err
+	}
+
+	order := Order{ChairID: id, Email: email, Price: chair.Price, Quantity: 1, CreatedAt: dbTime()}
+	if err := insertOrder(ctx, tx, &order); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func (s *mysqlChairStore) ReleaseExpiredReservations(ctx context.Context, now time.Time) (int, error) {
+	released, err := s.releaseExpiredReservations(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, count := range released {
+		n += int(count)
+	}
+	return n, nil
+}
+
+// releaseExpiredReservations 期限切れの取り置きを在庫に戻し、椅子ごとに戻した数を返す
+func (s *mysqlChairStore) releaseExpiredReservations(ctx context.Context, now time.Time) (map[int64]int64, error) {
+	expired, err := s.selectExpiredReservations(ctx, now)
+	if err != nil || len(expired) == 0 {
+		return nil, err
+	}
+	return s.releaseReservations(ctx, expired, now)
+}
+
+// selectExpiredReservations now までに期限が切れた取り置きをロックせずに読む
+func (s *mysqlChairStore) selectExpiredReservations(ctx context.Context, now time.Time) ([]Reservation, error) {
+	expired := []Reservation{}
+	query := "SELECT " + reservationColumns + " FROM chair_reservation WHERE expires_at <= ?"
+	if err := s.db.writer(ctx).SelectContext(ctx, &expired, query, now.UTC()); err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+// releaseReservations selectExpiredReservations で読んだ expired を在庫に戻し、椅子ごとに戻した数を返す
+func (s *mysqlChairStore) releaseReservations(ctx context.Context, expired []Reservation, now time.Time) (map[int64]int64, error) {
+	tx, err := s.db.writer(ctx).BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// 購入と同じく chair を id の昇順でロックしてから取り置きをロックする
+	chairIDs := make([]int64, 0, len(expired))
+	tokens := make([]string, 0, len(expired))
+	for _, r := range expired {
+		chairIDs = append(chairIDs, r.ChairID)
+		tokens = append(tokens, r.Token)
+	}
+	query, params, err := sqlx.In("SELECT id FROM chair WHERE id IN (?) ORDER BY id FOR UPDATE", chairIDs)
+	if err != nil {
+		return nil, err
+	}
+	var locked []int64
+	if err := tx.SelectContext(ctx, &locked, query, params...); err != nil {
+		return nil, err
+	}
+	// ロックを待つ間に購入された取り置きは除く
+	query, params, err = sqlx.In("SELECT "+reservationColumns+" FROM chair_reservation WHERE token IN (?) AND expires_at <= ? FOR UPDATE", tokens, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	expired = expired[:0]
+	if err := tx.SelectContext(ctx, &expired, query, params...); err != nil {
+		return nil, err
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	released := make(map[int64]int64)
+	tokens = tokens[:0]
+	for _, r := range expired {
+		released[r.ChairID]++
+		tokens = append(tokens, r.Token)
+	}
+	for chairID, count := range released {
+		if _, err := tx.ExecContext(ctx, "UPDATE chair SET stock = stock + ? WHERE id = ?", count, chairID); err != nil {
+			return nil, err
+		}
+	}
+	query, params, err = sqlx.In("DELETE FROM chair_reservation WHERE token IN (?)", tokens)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, query, params...); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return released, nil
+}
+
+func (s *mysqlChairStore) OrdersByEmail(ctx context.Context, email string, page, perPage int) (int64, []Order, error) {
+	return s.selectOrders(ctx, "email = ?", email, page, perPage)
+}
+
+func (s *mysqlChairStore) OrdersByChair(ctx context.Context, chairID int64, page, perPage int) (int64, []Order, error) {
+	return s.selectOrders(ctx, "chair_id = ?", chairID, page, perPage)
+}
+
+func (s *mysqlChairStore) selectOrders(ctx context.Context, condition string, param interface{}, page, perPage int) (int64, []Order, error) {
+	db := s.db.reader(ctx)
+
+	var count int64
+	if err := db.GetContext(ctx, &count, "SELECT COUNT(*) FROM orders WHERE "+condition, param); err != nil {
+		return 0, nil, err
+	}
+
+	orders := []Order{}
+	query := "SELECT " + orderColumns + " FROM orders WHERE " + condition + " ORDER BY id DESC LIMIT ? OFFSET ?"
+	if err := db.SelectContext(ctx, &orders, query, param, perPage, page*perPage); err != nil {
+		return 0, nil, err
+	}
+	return count, orders, nil
+}
+
+type mysqlEstateStore struct {
+	db     *dbRouter
+	logger echo.Logger
+	index  *spatial.Index
+	// chunkSize 一つの INSERT 文で挿入する行数
+	chunkSize int
+	// scripts Initialize で流すスクリプト。椅子と同じデータベースなら椅子の側で流すので空にする
+	scripts []string
+}
+
+func newMySQLEstateStore(db *dbRouter, logger echo.Logger, chunkSize int) *mysqlEstateStore {
+	return &mysqlEstateStore{db: db, logger: logger, index: spatial.New(estateIndexCellSize), chunkSize: chunkSize, scripts: estateSQLScripts}
+}
+
+func (s *mysqlEstateStore) Initialize(ctx context.Context) error {
+	if err := runSQLScripts(ctx, s.db.writer(ctx), s.logger, s.scripts); err != nil {
+		return err
+	}
+	return s.loadIndex(ctx)
+}
+
+func (s *mysqlEstateStore) GetEstate(ctx context.Context, id int64) (*Estate, error) {
+	var estate Estate
+	err := s.db.reader(ctx).GetContext(ctx, &estate, "SELECT "+estateColumns+" FROM estate WHERE id = ? LIMIT 1", id)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &estate, nil
+}
+
+// estateInsertHead estate に一行ずつ値を渡して書き込む INSERT / REPLACE 文の列。*_range は estateRows で計算する
+const estateInsertHead = "estate(id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, features_mask, popularity, door_width_range, door_height_range, rent_range)"
+
+// estateRows estates を estateInsertHead の順の値にする
+func estateRows(estates []Estate) []interface{} {
+	values := make([]interface{}, 0, len(estates)*16)
+	for _, estate := range estates {
+		doorWidthRange := getSizeId(int(estate.DoorWidth))
+		doorHeightRange := getSizeId(int(estate.DoorHeight))
+		rentRange := getRentPriceId(int(estate.Rent))
+		values = append(values, estate.ID, estate.Name, estate.Description, estate.Thumbnail, estate.Address, estate.Latitude, estate.Longitude, estate.Rent, estate.DoorHeight, estate.DoorWidth, estate.Features, estate.FeaturesMask, estate.Popularity, doorWidthRange, doorHeightRange, rentRange)
+	}
+	return values
+}
+
+// lockEstates estates のうち既にある物件を FOR UPDATE で読む
+func (s *mysqlEstateStore) lockEstates(ctx context.Context, tx *sqlx.Tx, estates []Estate) (map[int64]Estate, error) {
+	ids := make([]int64, 0, len(estates))
+	for _, estate := range estates {
+		ids = append(ids, estate.ID)
+	}
+	existing := make(map[int64]Estate, len(estates))
+	err := forEachChunk(ids, s.chunkSize, func(ids []int64) error {
+		query, params, err := sqlx.In("SELECT "+estateColumns+" FROM estate WHERE id IN (?) ORDER BY id FOR UPDATE", ids)
+		if err != nil {
+			return err
+		}
+		found := []Estate{}
+		if err := tx.SelectContext(ctx, &found, query, params...); err != nil {
+			return err
+		}
+		for _, estate := range found {
+			existing[estate.ID] = estate
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// mysqlEstateImporter 取り込みの間一つのトランザクションを開いておき、Write のたびに書き込む
+type mysqlEstateImporter struct {
+	s    *mysqlEstateStore
+	tx   *sqlx.Tx
+	mode ImportMode
+	// kept replace モードで書き込んだ物件の ID。Commit でこれ以外を削除する
+	kept map[int64]bool
+	// changed 追加・更新した物件の位置。コミットしてからインデックスに反映する
+	changed []spatial.Item
+	summary ImportSummary
+}
+
+func (s *mysqlEstateStore) ImportEstates(ctx context.Context, mode ImportMode) (EstateImporter, error) {
+	tx, err := s.db.writer(ctx).BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin tx: %w", err)
+	}
+	return &mysqlEstateImporter{s: s, tx: tx, mode: mode, kept: map[int64]bool{}}, nil
+}
+
+func (i *mysqlEstateImporter) Write(ctx context.Context, estates []Estate) error {
+	existing, err := i.s.lockEstates(ctx, i.tx, estates)
+	if err != nil {
+		return fmt.Errorf("failed to select estate: %w", err)
+	}
+	plan, err := planEstateImport(estates, existing, i.mode)
+	if err != nil {
+		return err
+	}
+
+	// max_allowed_packet やプレースホルダの上限を超えないよう chunkSize 行ずつ書き込む
+	if err := insertChunked(ctx, i.tx, "INSERT INTO "+estateInsertHead, 16, estateRows(plan.inserted), i.s.chunkSize); err != nil {
+		return fmt.Errorf("failed to insert estate: %w", err)
+	}
+	if len(plan.updated) > 0 {
+		// REPLACE で行ごと置き換えて *_range も計算し直す
+		if err := insertChunked(ctx, i.tx, "REPLACE INTO "+estateInsertHead, 16, estateRows(plan.updated), i.s.chunkSize); err != nil {
+			return fmt.Errorf("failed to update estate: %w", err)
+		}
+	}
+	changed := plan.changed()
+	for j := range changed {
+		i.changed = append(i.changed, changed[j].indexItem())
+	}
+	if i.mode == ImportReplace {
+		for _, estate := range estates {
+			i.kept[estate.ID] = true
+		}
+	}
+	i.summary.add(plan.summary)
+	return nil
+}
+
+func (i *mysqlEstateImporter) Commit(ctx context.Context) (ImportSummary, error) {
+	deleted := []int64{}
+	if i.mode == ImportReplace {
+		// 取り込みの間に追加された物件もアップロードに含まれなければ消すので、最後に全ての物件を FOR UPDATE で読む
+		existing := []int64{}
+		if err := i.tx.SelectContext(ctx, &existing, "SELECT id FROM estate ORDER BY id FOR UPDATE"); err != nil {
+			return ImportSummary{}, fmt.Errorf("failed to select estate: %w", err)
+		}
+		deleted = missingIDs(existing, i.kept)
+		if err := execInChunked(ctx, i.tx, "DELETE FROM estate WHERE id IN (?)", deleted, i.s.chunkSize); err != nil {
+			return ImportSummary{}, fmt.Errorf("failed to delete estate: %w", err)
+		}
+		i.summary.Deleted = len(deleted)
+	}
+	if err := i.tx.Commit(); err != nil {
+		return ImportSummary{}, fmt.Errorf("failed to commit tx: %w", err)
+	}
+
+	i.s.index.Insert(i.changed...)
+	i.s.index.Remove(deleted...)
+	return i.summary, nil
+}
+
+func (i *mysqlEstateImporter) Rollback() error {
+	if err := i.tx.Rollback(); err != nil && err != sql.ErrTxDone {
+		return err
+	}
+	return nil
+}
+
+// estateConditions 検索条件を WHERE 句の条件とパラメータにする
+func estateConditions(q EstateSearchQuery) ([]string, []interface{}) {
+	conditions := make([]string, 0)
+	params := make([]interface{}, 0)
+
+	if len(q.DoorHeightRangeIDs) > 0 {
+		conditions = append(conditions, inCondition("door_height_range", len(q.DoorHeightRangeIDs)))
+		params = appendInt64s(params, q.DoorHeightRangeIDs)
+	}
+	if len(q.DoorWidthRangeIDs) > 0 {
+		conditions = append(conditions, inCondition("door_width_range", len(q.DoorWidthRangeIDs)))
+		params = appendInt64s(params, q.DoorWidthRangeIDs)
+	}
+	if len(q.RentRangeIDs) > 0 {
+		conditions = append(conditions, inCondition("rent_range", len(q.RentRangeIDs)))
+		params = appendInt64s(params, q.RentRangeIDs)
+	}
+	conditions, params = appendBoundsConditions(conditions, params, "rent", q.Rent)
+	conditions, params = appendBoundsConditions(conditions, params, "door_width", q.DoorWidth)
+	conditions, params = appendBoundsConditions(conditions, params, "door_height", q.DoorHeight)
+	if q.FeaturesMask != 0 {
+		conditions = append(conditions, "features_mask & ? = ?")
+		params = append(params, q.FeaturesMask, q.FeaturesMask)
+	}
+	return conditions, params
+}
+
+// ExportEstates 結果を一度に持たないよう、行を読みながら fn に渡す
+func (s *mysqlEstateStore) ExportEstates(ctx context.Context, q EstateSearchQuery, fn func(Estate) error) error {
+	conditions, params := estateConditions(q)
+	conditions = append(conditions, "TRUE")
+	query := "SELECT " + estateColumns + " FROM estate WHERE " + strings.Join(conditions, " AND ") + " ORDER BY id ASC"
+	rows, err := s.db.reader(ctx).QueryxContext(ctx, query, params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var estate Estate
+		if err := rows.StructScan(&estate); err != nil {
+			return err
+		}
+		if err := fn(estate); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *mysqlEstateStore) SearchEstates(ctx context.Context, q EstateSearchQuery) (int64, []Estate, error) {
+	conditions, params := estateConditions(q)
+	if len(conditions) == 0 {
+		conditions = append(conditions, "TRUE")
+	}
+
+	searchQuery := "SELECT " + estateColumns + " FROM estate WHERE "
+	countQuery := "SELECT COUNT(id) FROM estate WHERE "
+	searchCondition := strings.Join(conditions, " AND ")
+	limitOffset := " ORDER BY popularity DESC, id ASC LIMIT ? OFFSET ?"
+
+	db := s.db.reader(ctx)
+	var count int64
+	if err := db.GetContext(ctx, &count, countQuery+searchCondition, params...); err != nil {
+		return 0, nil, err
+	}
+
+	estates := []Estate{}
+	params = append(params, q.PerPage, q.Page*q.PerPage)
+	if err := db.SelectContext(ctx, &estates, searchQuery+searchCondition+limitOffset, params...); err != nil { // これが思い
+		return 0, nil, err
+	}
+	return count, estates, nil
+}
+
+func appendBoundsConditions(conditions []string, params []interface{}, column string, b Bounds) ([]string, []interface{}) {
+	if b.Min >= 0 {
+		conditions = append(conditions, column+" >= ?")
+		params = append(params, b.Min)
+	}
+	if b.Max >= 0 {
+		conditions = append(conditions, column+" <= ?")
+		params = append(params, b.Max)
+	}
+	return conditions, params
+}
+
+func (s *mysqlEstateStore) LowPricedEstates(ctx context.Context, limit int) ([]Estate, error) {
+	estates := make([]Estate, 0, limit)
+	query := `SELECT ` + estateColumns + ` FROM estate ORDER BY rent ASC, id ASC LIMIT ?`
+	err := s.db.reader(ctx).SelectContext(ctx, &estates, query, limit)
+	return estates, err
+}
+
+func (s *mysqlEstateStore) RecommendedEstates(ctx context.Context, w, h, d int64, limit int) ([]Estate, error) {
+	estates := []Estate{}
+	query := `SELECT ` + estateColumns + ` FROM estate WHERE (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) ORDER BY popularity DESC, id ASC LIMIT ?`
+	err := s.db.reader(ctx).SelectContext(ctx, &estates, query, w, h, w, d, h, w, h, d, d, w, d, h, limit)
+	return estates, err
+}
+
+func (s *mysqlEstateStore) SearchEstatesInPolygon(ctx context.Context, polygon spatial.Polygon, limit int) ([]Estate, error) {
+	candidates := s.index.SearchPolygon(polygon, limit)
+	if len(candidates) == 0 {
+		return []Estate{}, nil
+	}
+
+	ids := make([]int64, 0, len(candidates))
+	for _, item := range candidates {
+		ids = append(ids, item.ID)
+	}
+	query, params, err := sqlx.In(`SELECT `+estateColumns+` FROM estate WHERE id IN (?)`, ids)
+	if err != nil {
+		return nil, err
+	}
+	estates := []Estate{}
+	db := s.db.reader(ctx)
+	if err := db.SelectContext(ctx, &estates, db.Rebind(query), params...); err != nil {
+		return nil, err
+	}
+
+	// インデックスが返した popularity DESC, id ASC の順に並べ直す
+	byID := make(map[int64]Estate, len(estates))
+	for _, estate := range estates {
+		byID[estate.ID] = estate
+	}
+	estatesInPolygon := make([]Estate, 0, len(candidates))
+	for _, id := range ids {
+		if estate, ok := byID[id]; ok {
+			estatesInPolygon = append(estatesInPolygon, estate)
+		}
+	}
+	return estatesInPolygon, nil
+}
+
+func appendInt64s(params []interface{}, values []int64) []interface{} {
+	for _, v := range values {
+		params = append(params, v)
+	}
+	return params
+}
+
+func (s *mysqlEstateStore) CreateDocumentRequest(ctx context.Context, estateID int64, email string, since time.Time) (*DocumentRequest, error) {
+	tx, err := s.db.writer(ctx).BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// 物件の行をロックして、同じ物件への資料請求の重複確認と追加を直列化する
+	var id int64
+	if err := tx.GetContext(ctx, &id, "SELECT id FROM estate WHERE id = ? FOR UPDATE", estateID); err != nil {
+		return nil, notFound(err)
+	}
+	var count int64
+	query := "SELECT COUNT(*) FROM document_request WHERE estate_id = ? AND email = ? AND created_at >= ?"
+	if err := tx.GetContext(ctx, &count, query, estateID, email, since.UTC()); err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrDuplicateDocumentRequest
+	}
+
+	now := dbTime()
+	req := DocumentRequest{EstateID: estateID, Email: email, Status: DocumentRequestPending, CreatedAt: now, UpdatedAt: now}
+	res, err := tx.ExecContext(ctx, "INSERT INTO document_request(estate_id, email, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		req.EstateID, req.Email, req.Status, req.CreatedAt, req.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert document_request: %w", err)
+	}
+	if req.ID, err = res.LastInsertId(); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (s *mysqlEstateStore) DocumentRequests(ctx context.Context, q DocumentRequestQuery) (int64, []DocumentRequest, error) {
+	conditions := make([]string, 0)
+	params := make([]interface{}, 0)
+	if q.EstateID != 0 {
+		conditions = append(conditions, "estate_id = ?")
+		params = append(params, q.EstateID)
+	}
+	if q.Email != "" {
+		conditions = append(conditions, "email = ?")
+		params = append(params, q.Email)
+	}
+	if q.Status != "" {
+		conditions = append(conditions, "status = ?")
+		params = append(params, q.Status)
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	db := s.db.reader(ctx)
+	var count int64
+	if err := db.GetContext(ctx, &count, "SELECT COUNT(*) FROM document_request"+where, params...); err != nil {
+		return 0, nil, err
+	}
+
+	requests := []DocumentRequest{}
+	query := "SELECT " + documentRequestColumns + " FROM document_request" + where + " ORDER BY id DESC LIMIT ? OFFSET ?"
+	params = append(params, q.PerPage, q.Page*q.PerPage)
+	if err := db.SelectContext(ctx, &requests, query, params...); err != nil {
+		return 0, nil, err
+	}
+	return count, requests, nil
+}
+
+func (s *mysqlEstateStore) UpdateDocumentRequestStatus(ctx context.Context, id int64, status string) (*DocumentRequest, error) {
+	tx, err := s.db.writer(ctx).BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var req DocumentRequest
+	if err := tx.GetContext(ctx, &req, "SELECT "+documentRequestColumns+" FROM document_request WHERE id = ? FOR UPDATE", id); err != nil {
+		return nil, notFound(err)
+	}
+	if !canTransition(req.Status, status) {
+		return nil, ErrInvalidStatusTransition
+	}
+
+	req.Status, req.UpdatedAt = status, dbTime()
+	if _, err := tx.ExecContext(ctx, "UPDATE document_request SET status = ?, updated_at = ? WHERE id = ?", req.Status, req.UpdatedAt, id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
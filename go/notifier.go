@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo"
+)
+
+// DocumentRequestNotifier 物件の資料請求があったことを知らせる
+type DocumentRequestNotifier interface {
+	Notify(ctx context.Context, req *DocumentRequest, estate *Estate) error
+}
+
+// newDocumentRequestNotifier DOCUMENT_REQUEST_NOTIFY_FILE が指定されていればそのファイルに、なければログに資料請求を書く
+func newDocumentRequestNotifier(logger echo.Logger) DocumentRequestNotifier {
+	if path := getEnv("DOCUMENT_REQUEST_NOTIFY_FILE", ""); path != "" {
+		return &fileNotifier{path: path}
+	}
+	return &logNotifier{logger: logger}
+}
+
+// logNotifier 資料請求をログに出すだけの DocumentRequestNotifier
+type logNotifier struct {
+	logger echo.Logger
+}
+
+func (n *logNotifier) Notify(ctx context.Context, req *DocumentRequest, estate *Estate) error {
+	n.logger.Infof("document request %v: %v requested documents of estate %v (%v)", req.ID, req.Email, estate.ID, estate.Name)
+	return nil
+}
+
+// fileNotifier 資料請求を JSON で一行ずつファイルに追記する DocumentRequestNotifier
+type fileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+type documentRequestNotification struct {
+	Request    *DocumentRequest `json:"request"`
+	EstateName string           `json:"estateName"`
+	Address    string           `json:"address"`
+}
+
+func (n *fileNotifier) Notify(ctx context.Context, req *DocumentRequest, estate *Estate) error {
+	b, err := json.Marshal(documentRequestNotification{Request: req, EstateName: estate.Name, Address: estate.Address})
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %v: %w", n.path, err)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %v: %w", n.path, err)
+	}
+	return f.Close()
+}
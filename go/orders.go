@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// ListPerPageLimit 購入記録などの一覧で一度に返せる件数の上限
+const ListPerPageLimit = 100
+
+// getPagination page と perPage を読む。省略時は 0 ページ目を Limit 件ずつ返す
+func getPagination(c echo.Context) (int, int, bool) {
+	page, perPage := 0, Limit
+	var err error
+	if v := c.QueryParam("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 0 {
+			c.Logger().Infof("Invalid format page parameter : %v", v)
+			return 0, 0, false
+		}
+	}
+	if v := c.QueryParam("perPage"); v != "" {
+		if perPage, err = strconv.Atoi(v); err != nil || perPage <= 0 || perPage > ListPerPageLimit {
+			c.Logger().Infof("Invalid format perPage parameter : %v", v)
+			return 0, 0, false
+		}
+	}
+	return page, perPage, true
+}
+
+func (s *server) getOrders(c echo.Context) error {
+	email := c.QueryParam("email")
+	if email == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "email is required"})
+	}
+	page, perPage, ok := getPagination(c)
+	if !ok {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	var res OrderListResponse
+	var err error
+	res.Count, res.Orders, err = s.chairs.OrdersByEmail(c.Request().Context(), email, page, perPage)
+	if err != nil {
+		c.Logger().Errorf("getOrders DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (s *server) getChairOrders(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.NoContent(http.StatusBadRequest)
+	}
+	page, perPage, ok := getPagination(c)
+	if !ok {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	ctx := c.Request().Context()
+	if _, err := s.chairs.GetChair(ctx, int64(id)); err != nil {
+		if err == ErrNotFound {
+			return c.NoContent(http.StatusNotFound)
+		}
+		c.Logger().Errorf("getChairOrders DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var res OrderListResponse
+	res.Count, res.Orders, err = s.chairs.OrdersByChair(ctx, int64(id), page, perPage)
+	if err != nil {
+		c.Logger().Errorf("getChairOrders DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recoCacheSize おすすめ物件キャッシュに保持する椅子の形の最大数
+const recoCacheSize = 4096
+
+// chairShape 椅子の幅・高さ・奥行きを小さい順に並べたもの
+// おすすめ物件は椅子をどの向きで入れてもよいので、同じ形の椅子は同じ結果になる
+type chairShape [3]int64
+
+func newChairShape(w, h, d int64) chairShape {
+	s := chairShape{w, h, d}
+	sort.Slice(s[:], func(i, j int) bool { return s[i] < s[j] })
+	return s
+}
+
+type recoEntry struct {
+	shape   chairShape
+	estates []Estate
+}
+
+// recoCache 椅子の形ごとにおすすめ物件を保持する LRU キャッシュ
+type recoCache struct {
+	size  int
+	limit int
+
+	mu      sync.Mutex
+	entries map[chairShape]*list.Element
+	lru     *list.List
+	// gen clear や invalidate のたびに増やし、古い検索結果で上書きしないようにする
+	gen uint64
+	// invalidatedAt 最後に clear か invalidate をした時刻
+	invalidatedAt time.Time
+
+	hits   uint64
+	misses uint64
+}
+
+func newRecoCache(size, limit int) *recoCache {
+	return &recoCache{
+		size:    size,
+		limit:   limit,
+		entries: map[chairShape]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// get キャッシュされたおすすめ物件を返す。ミスした場合は set に渡す世代を返す
+func (c *recoCache) get(shape chairShape) ([]Estate, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[shape]; ok {
+		c.lru.MoveToFront(e)
+		atomic.AddUint64(&c.hits, 1)
+		return e.Value.(*recoEntry).estates, c.gen, true
+	}
+	atomic.AddUint64(&c.misses, 1)
+	return nil, c.gen, false
+}
+
+// set 検索結果をキャッシュする。get の後に clear や invalidate があった場合は捨てる
+func (c *recoCache) set(shape chairShape, estates []Estate, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gen != gen {
+		return
+	}
+	if e, ok := c.entries[shape]; ok {
+		e.Value.(*recoEntry).estates = estates
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[shape] = c.lru.PushFront(&recoEntry{shape: shape, estates: estates})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*recoEntry).shape)
+	}
+}
+
+// invalidate 追加された物件によって結果が変わりうるエントリだけを捨てる
+func (c *recoCache) invalidate(inserted []Estate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.invalidatedAt = time.Now()
+	for shape, e := range c.entries {
+		if c.affected(e.Value.(*recoEntry).estates, shape, inserted) {
+			c.lru.Remove(e)
+			delete(c.entries, shape)
+		}
+	}
+}
+
+// affected inserted のいずれかが shape の椅子に対するおすすめ上位 limit 件に入りうるかを判定する
+func (c *recoCache) affected(cached []Estate, shape chairShape, inserted []Estate) bool {
+	for i := range inserted {
+		estate := &inserted[i]
+		if !estate.fitsChair(shape[0], shape[1], shape[2]) {
+			continue
+		}
+		if len(cached) < c.limit {
+			return true
+		}
+		last := cached[len(cached)-1]
+		if estate.Popularity > last.Popularity || (estate.Popularity == last.Popularity && estate.ID < last.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+// clear キャッシュを全て捨てる
+func (c *recoCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[chairShape]*list.Element{}
+	c.lru.Init()
+	c.gen++
+	c.invalidatedAt = time.Now()
+}
+
+// refillFromPrimary 書き込みの直後なので、読み込み直すときはプライマリから読むべきかを返す
+func (c *recoCache) refillFromPrimary() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return time.Since(c.invalidatedAt) < cachePrimaryRefillWindow
+}
+
+func (c *recoCache) stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// defaultReservationTTL 椅子の取り置きを保持する時間の既定値
+	defaultReservationTTL = 10 * time.Minute
+	// reservationSweepInterval 期限切れの取り置きを解放する間隔
+	reservationSweepInterval = 30 * time.Second
+)
+
+// Reservation 購入前に在庫を一つ取り置いたもの。取り置いている間は在庫から除く
+type Reservation struct {
+	Token     string    `db:"token" json:"token"`
+	ChairID   int64     `db:"chair_id" json:"chairId"`
+	ExpiresAt time.Time `db:"expires_at" json:"expiresAt"`
+}
+
+// loadReservationTTL CHAIR_RESERVATION_TTL 環境変数 (10m などの time.Duration 形式) から取り置きの時間を決める
+func loadReservationTTL() (time.Duration, error) {
+	v := getEnv("CHAIR_RESERVATION_TTL", "")
+	if v == "" {
+		return defaultReservationTTL, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid CHAIR_RESERVATION_TTL %q", v)
+	}
+	return d, nil
+}
+
+// newReservationToken 推測できない取り置きのトークンを作る
+func newReservationToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *server) reserveChair(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	token, err := newReservationToken()
+	if err != nil {
+		c.Logger().Errorf("failed to generate reservation token : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	r := Reservation{Token: token, ChairID: int64(id), ExpiresAt: dbTime().Add(s.reservationTTL)}
+	if err := s.chairs.ReserveChair(c.Request().Context(), r); err != nil {
+		if err == ErrNotFound {
+			return c.NoContent(http.StatusNotFound)
+		}
+		c.Logger().Errorf("reserveChair DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+// runReservationSweeper ctx が終わるまで定期的に期限切れの取り置きを在庫に戻す
+func (s *server) runReservationSweeper(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(reservationSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			released, err := s.chairs.ReleaseExpiredReservations(ctx, time.Now())
+			if err != nil {
+				logger.Errorf("failed to release expired reservations : %v", err)
+			} else if released > 0 {
+				logger.Infof("released %v expired reservations", released)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func reserve(t *testing.T, s *server, id int64) Reservation {
+	t.Helper()
+	r := Reservation{Token: "token-" + time.Now().Format(time.RFC3339Nano), ChairID: id, ExpiresAt: dbTime().Add(time.Minute)}
+	if err := s.chairs.ReserveChair(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func expectStock(t *testing.T, s *server, id, stock int64) {
+	t.Helper()
+	chair, err := s.chairs.GetChair(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chair.Stock != stock {
+		t.Fatalf("stock of chair %v = %v, want %v", id, chair.Stock, stock)
+	}
+}
+
+func importSummary(t *testing.T, rec *httptest.ResponseRecorder) ImportSummary {
+	t.Helper()
+	var report ImportReport
+	decode(t, rec, &report)
+	if report.Summary == nil {
+		t.Fatalf("no summary in %s", rec.Body.String())
+	}
+	return *report.Summary
+}
+
+// アップロードの在庫は取り置きを含む数として扱い、期限切れで戻しても在庫が増えすぎない
+func TestUpsertKeepsOpenReservations(t *testing.T) {
+	for _, mode := range []ImportMode{ImportUpsert, ImportReplace} {
+		t.Run(string(mode), func(t *testing.T) {
+			s, e := newTestServer(t)
+			expectStatus(t, uploadCSV(e, "/api/chair", "chairs", chairCSVRow(1, 1000, 3)), http.StatusCreated)
+			reserve(t, s, 1)
+			expectStock(t, s, 1, 2)
+
+			rec := uploadCSV(e, "/api/chair?mode="+string(mode), "chairs", chairCSVRow(1, 1000, 5))
+			expectStatus(t, rec, http.StatusCreated)
+			if got := importSummary(t, rec); got.Updated != 1 {
+				t.Fatalf("summary = %+v, want 1 updated", got)
+			}
+			expectStock(t, s, 1, 4)
+
+			// 同じ在庫をもう一度送っても変わらない
+			rec = uploadCSV(e, "/api/chair?mode="+string(mode), "chairs", chairCSVRow(1, 1000, 5))
+			expectStatus(t, rec, http.StatusCreated)
+			if got := importSummary(t, rec); got.Unchanged != 1 {
+				t.Fatalf("summary = %+v, want 1 unchanged", got)
+			}
+
+			released, err := s.chairs.ReleaseExpiredReservations(context.Background(), time.Now().Add(time.Hour))
+			if err != nil || released != 1 {
+				t.Fatalf("released = %v, %v", released, err)
+			}
+			expectStock(t, s, 1, 5)
+		})
+	}
+}
+
+func TestUpsertCancelsReservationsBeyondStock(t *testing.T) {
+	s, e := newTestServer(t)
+	expectStatus(t, uploadCSV(e, "/api/chair", "chairs", chairCSVRow(1, 1000, 3)), http.StatusCreated)
+	kept := reserve(t, s, 1)
+	cancelled := Reservation{Token: "later", ChairID: 1, ExpiresAt: kept.ExpiresAt.Add(time.Minute)}
+	if err := s.chairs.ReserveChair(context.Background(), cancelled); err != nil {
+		t.Fatal(err)
+	}
+
+	expectStatus(t, uploadCSV(e, "/api/chair?mode=upsert", "chairs", chairCSVRow(1, 1000, 1)), http.StatusCreated)
+	expectStock(t, s, 1, 0)
+
+	// 期限の遅い取り置きから取り消す
+	if _, err := s.chairs.BuyReservedChair(context.Background(), cancelled.Token, 1, "a@example.com"); err != ErrInvalidReservation {
+		t.Fatalf("BuyReservedChair with the cancelled reservation = %v, want ErrInvalidReservation", err)
+	}
+	if _, err := s.chairs.BuyReservedChair(context.Background(), kept.Token, 1, "a@example.com"); err != nil {
+		t.Fatalf("BuyReservedChair with the kept reservation = %v", err)
+	}
+	released, err := s.chairs.ReleaseExpiredReservations(context.Background(), time.Now().Add(time.Hour))
+	if err != nil || released != 0 {
+		t.Fatalf("released = %v, %v", released, err)
+	}
+	expectStock(t, s, 1, 0)
+}
+
+func TestSubtractReservations(t *testing.T) {
+	chairs := []Chair{{ID: 1, Stock: 5}, {ID: 2, Stock: 1}, {ID: 3, Stock: 2}}
+	adjusted, excess := subtractReservations(chairs, map[int64]int64{1: 2, 2: 3})
+	if adjusted[0].Stock != 3 || adjusted[1].Stock != 0 || adjusted[2].Stock != 2 {
+		t.Fatalf("adjusted = %+v", adjusted)
+	}
+	if len(excess) != 1 || excess[2] != 2 {
+		t.Fatalf("excess = %v, want map[2:2]", excess)
+	}
+	if chairs[0].Stock != 5 {
+		t.Fatal("subtractReservations modified its argument")
+	}
+}
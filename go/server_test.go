@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+const testAdminToken = "test-admin-token"
+
+// newTestServer メモリ上の保存先を使うサーバーを作る
+func newTestServer(t testing.TB) (*server, *echo.Echo) {
+	t.Helper()
+	e := echo.New()
+	s := &server{
+		chairs:  newMemoryChairStore(),
+		estates: newMemoryEstateStore(),
+
+		lowPricedEstates:   newLowPricedEstateCache(Limit),
+		recommendedEstates: newRecoCache(recoCacheSize, Limit),
+
+		idempotency: newIdempotencyStore(defaultIdempotencyWindow),
+
+		documentNotifier:        newDocumentRequestNotifier(e.Logger),
+		documentRequestInterval: defaultDocumentRequestInterval,
+		reservationTTL:          defaultReservationTTL,
+		csvImport:               csvImportConfig{ChunkSize: defaultImportChunkSize, MaxRows: defaultImportMaxRows, MaxBytes: defaultImportMaxBytes},
+		adminToken:              testAdminToken,
+	}
+	s.registerRoutes(e)
+	return s, e
+}
+
+func doRequest(e *echo.Echo, method, path string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	if contentType != "" {
+		req.Header.Set(echo.HeaderContentType, contentType)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func doJSON(e *echo.Echo, method, path string, body interface{}) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(body)
+	return doRequest(e, method, path, bytes.NewReader(b), echo.MIMEApplicationJSON)
+}
+
+// uploadCSV field のファイルとして data を multipart で送る
+func uploadCSV(e *echo.Echo, path, field, data string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	f, _ := w.CreateFormFile(field, field+".csv")
+	io.WriteString(f, data)
+	w.Close()
+	return doRequest(e, http.MethodPost, path, &body, w.FormDataContentType())
+}
+
+func chairCSVRow(id, price, stock int64) string {
+	return fmt.Sprintf("%v,椅子%v,説明,/images/chair/%v.png,%v,100,70,60,黒,肘掛け付き,座椅子,%v,%v\n", id, id, id, price, id, stock)
+}
+
+func estateCSVRow(id, rent, doorHeight, doorWidth int64, lat, lon float64) string {
+	return fmt.Sprintf("%v,物件%v,説明,/images/estate/%v.png,東京都,%v,%v,%v,%v,%v,最上階,%v\n", id, id, id, lat, lon, rent, doorHeight, doorWidth, id)
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+	}
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status = %v, want %v: %s", rec.Code, status, rec.Body.String())
+	}
+}
+
+func TestChairPurchaseRemovesSoldOutChair(t *testing.T) {
+	_, e := newTestServer(t)
+
+	expectStatus(t, uploadCSV(e, "/api/chair", "chairs", chairCSVRow(1, 2000, 1)+chairCSVRow(2, 1000, 5)), http.StatusCreated)
+
+	var search ChairSearchResponse
+	rec := doRequest(e, http.MethodGet, "/api/chair/search?priceRangeId=0&page=0&perPage=10", nil, "")
+	expectStatus(t, rec, http.StatusOK)
+	decode(t, rec, &search)
+	if search.Count != 2 {
+		t.Fatalf("count = %v, want 2", search.Count)
+	}
+
+	expectStatus(t, doJSON(e, http.MethodPost, "/api/chair/buy/1", map[string]string{"email": "a@example.com"}), http.StatusOK)
+	expectStatus(t, doJSON(e, http.MethodPost, "/api/chair/buy/1", map[string]string{"email": "a@example.com"}), http.StatusNotFound)
+	expectStatus(t, doRequest(e, http.MethodGet, "/api/chair/1", nil, ""), http.StatusNotFound)
+
+	rec = doRequest(e, http.MethodGet, "/api/chair/search?priceRangeId=0&page=0&perPage=10", nil, "")
+	decode(t, rec, &search)
+	if search.Count != 1 || search.Chairs[0].ID != 2 {
+		t.Fatalf("search after sold out = %+v", search)
+	}
+
+	var low ChairListResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/chair/low_priced", nil, ""), &low)
+	if len(low.Chairs) != 1 || low.Chairs[0].ID != 2 {
+		t.Fatalf("low priced after sold out = %+v", low.Chairs)
+	}
+
+	var orders OrderListResponse
+	decode(t, doAdminRequest(e, http.MethodGet, "/api/orders?email=a@example.com", "Bearer "+testAdminToken), &orders)
+	if orders.Count != 1 || orders.Orders[0].ChairID != 1 || orders.Orders[0].Price != 2000 {
+		t.Fatalf("orders = %+v", orders)
+	}
+}
+
+func TestCheckoutIsAtomic(t *testing.T) {
+	s, e := newTestServer(t)
+	expectStatus(t, uploadCSV(e, "/api/chair", "chairs", chairCSVRow(1, 1000, 3)+chairCSVRow(2, 1000, 1)), http.StatusCreated)
+
+	rec := doJSON(e, http.MethodPost, "/api/chair/checkout", CheckoutRequest{
+		Email: "a@example.com",
+		Items: []CartItem{{ChairID: 1, Quantity: 2}, {ChairID: 2, Quantity: 2}},
+	})
+	expectStatus(t, rec, http.StatusConflict)
+	var res CheckoutErrorResponse
+	decode(t, rec, &res)
+	if len(res.Items) != 1 || res.Items[0] != (StockShortage{ChairID: 2, Requested: 2, Available: 1}) {
+		t.Fatalf("shortage = %+v", res.Items)
+	}
+	chair, _ := s.chairs.GetChair(context.Background(), 1)
+	if chair.Stock != 3 {
+		t.Fatalf("stock of chair 1 = %v after failed checkout, want 3", chair.Stock)
+	}
+
+	rec = doJSON(e, http.MethodPost, "/api/chair/checkout", CheckoutRequest{
+		Email: "a@example.com",
+		Items: []CartItem{{ChairID: 2, Quantity: 1}, {ChairID: 1, Quantity: 1}, {ChairID: 1, Quantity: 1}},
+	})
+	expectStatus(t, rec, http.StatusOK)
+	var ok CheckoutResponse
+	decode(t, rec, &ok)
+	if len(ok.Orders) != 2 || ok.Orders[0].ChairID != 1 || ok.Orders[0].Quantity != 2 {
+		t.Fatalf("orders = %+v", ok.Orders)
+	}
+}
+
+func TestEstateSearchAndRecommendation(t *testing.T) {
+	_, e := newTestServer(t)
+	estates := estateCSVRow(1, 40000, 100, 100, 35.0, 139.0) +
+		estateCSVRow(2, 30000, 50, 50, 35.1, 139.1) +
+		estateCSVRow(3, 120000, 200, 200, 36.0, 140.0)
+	expectStatus(t, uploadCSV(e, "/api/estate", "estates", estates), http.StatusCreated)
+	expectStatus(t, uploadCSV(e, "/api/chair", "chairs", chairCSVRow(1, 1000, 1)), http.StatusCreated)
+
+	var search EstateSearchResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/estate/search?rentRangeId=0&page=0&perPage=10", nil, ""), &search)
+	if search.Count != 2 || search.Estates[0].ID != 2 || search.Estates[1].ID != 1 {
+		t.Fatalf("search = %+v", search)
+	}
+
+	var low EstateListResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/estate/low_priced", nil, ""), &low)
+	if len(low.Estates) != 3 || low.Estates[0].ID != 2 || low.Estates[2].ID != 3 {
+		t.Fatalf("low priced = %+v", low.Estates)
+	}
+
+	// 椅子 1 は 70x100x60 なので、ドアが 50x50 の物件 2 には入らない
+	var reco EstateListResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/recommended_estate/1", nil, ""), &reco)
+	if len(reco.Estates) != 2 || reco.Estates[0].ID != 3 || reco.Estates[1].ID != 1 {
+		t.Fatalf("recommended = %+v", reco.Estates)
+	}
+
+	var nazotte EstateSearchResponse
+	decode(t, doJSON(e, http.MethodPost, "/api/estate/nazotte", Coordinates{Coordinates: []Coordinate{
+		{Latitude: 34.9, Longitude: 138.9}, {Latitude: 34.9, Longitude: 139.5}, {Latitude: 35.5, Longitude: 139.5}, {Latitude: 35.5, Longitude: 138.9},
+	}}), &nazotte)
+	if nazotte.Count != 2 || nazotte.Estates[0].ID != 2 || nazotte.Estates[1].ID != 1 {
+		t.Fatalf("nazotte = %+v", nazotte)
+	}
+}
+
+func TestDocumentRequestIsRateLimited(t *testing.T) {
+	_, e := newTestServer(t)
+	expectStatus(t, uploadCSV(e, "/api/estate", "estates", estateCSVRow(1, 40000, 100, 100, 35.0, 139.0)), http.StatusCreated)
+
+	body := map[string]string{"email": "a@example.com"}
+	expectStatus(t, doJSON(e, http.MethodPost, "/api/estate/req_doc/1", body), http.StatusOK)
+	expectStatus(t, doJSON(e, http.MethodPost, "/api/estate/req_doc/1", body), http.StatusTooManyRequests)
+	expectStatus(t, doJSON(e, http.MethodPost, "/api/estate/req_doc/2", body), http.StatusNotFound)
+}
+
+func TestPostChairReportsInvalidRows(t *testing.T) {
+	s, e := newTestServer(t)
+	rows := chairCSVRow(1, 1000, 1) + strings.Replace(chairCSVRow(2, 1000, 1), "黒", "虹色", 1) + chairCSVRow(1, 1000, 1)
+	rec := uploadCSV(e, "/api/chair", "chairs", rows)
+	expectStatus(t, rec, http.StatusBadRequest)
+	var report ImportReport
+	decode(t, rec, &report)
+	if report.ErrorCount != 2 || report.Errors[0].Line != 2 || report.Errors[1].Line != 3 {
+		t.Fatalf("report = %+v", report)
+	}
+	if _, err := s.chairs.GetChair(context.Background(), 1); err != ErrNotFound {
+		t.Fatalf("chair 1 was written despite invalid rows: %v", err)
+	}
+}
+
+func TestNazotteReturnsMostPopularWithinLimit(t *testing.T) {
+	_, e := newTestServer(t)
+	var rows strings.Builder
+	for id := int64(1); id <= NazotteLimit+10; id++ {
+		rows.WriteString(estateCSVRow(id, 40000, 100, 100, 35+float64(id)/1000, 139))
+	}
+	// 辺の上の物件は含まない
+	rows.WriteString(estateCSVRow(1000, 40000, 100, 100, 35.5, 138.9))
+	expectStatus(t, uploadCSV(e, "/api/estate", "estates", rows.String()), http.StatusCreated)
+
+	var res EstateSearchResponse
+	decode(t, doJSON(e, http.MethodPost, "/api/estate/nazotte", Coordinates{Coordinates: []Coordinate{
+		{Latitude: 34.9, Longitude: 138.9}, {Latitude: 34.9, Longitude: 139.5}, {Latitude: 35.9, Longitude: 139.5}, {Latitude: 35.9, Longitude: 138.9},
+	}}), &res)
+	if res.Count != NazotteLimit || len(res.Estates) != NazotteLimit {
+		t.Fatalf("count = %v, want %v", res.Count, NazotteLimit)
+	}
+	// estateCSVRow は popularity を id にするので、id の大きい順に並ぶ
+	for i, estate := range res.Estates {
+		if want := int64(NazotteLimit + 10 - i); estate.ID != want {
+			t.Fatalf("estates[%v].ID = %v, want %v", i, estate.ID, want)
+		}
+	}
+}
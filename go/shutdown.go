@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// defaultShutdownTimeout 終了時に処理中のリクエストを待つ時間の既定値
+const defaultShutdownTimeout = 10 * time.Second
+
+// loadShutdownTimeout SHUTDOWN_TIMEOUT 環境変数 (10s などの time.Duration 形式) から終了時の待ち時間を決める
+func loadShutdownTimeout() (time.Duration, error) {
+	v := getEnv("SHUTDOWN_TIMEOUT", "")
+	if v == "" {
+		return defaultShutdownTimeout, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid SHUTDOWN_TIMEOUT %q", v)
+	}
+	return d, nil
+}
+
+// shutdown 新しいリクエストの受け付けを止め、処理中のリクエストを timeout まで待ってからコネクションプールを閉じる
+// 期限を過ぎたリクエストは接続を切る。リクエストのコンテキストが取り消されるので、途中のトランザクションはロールバックされる
+func (s *server) shutdown(e *echo.Echo, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := e.Shutdown(ctx); err != nil {
+		e.Logger.Warnf("in-flight requests did not finish within %v, closing connections : %v", timeout, err)
+		if err := e.Close(); err != nil {
+			e.Logger.Errorf("failed to close server : %v", err)
+		}
+	} else {
+		e.Logger.Infof("drained in-flight requests in %v", time.Since(start))
+	}
+
+	s.flush(e.Logger)
+
+	// メモリ上の保存先で動かしているときは閉じるコネクションプールがない
+	if s.chairDB != nil {
+		if err := s.chairDB.Close(); err != nil {
+			e.Logger.Errorf("failed to close chair database : %v", err)
+		}
+	}
+	if s.estateDB != nil {
+		if err := s.estateDB.Close(); err != nil {
+			e.Logger.Errorf("failed to close estate database : %v", err)
+		}
+	}
+}
+
+// flush 最後のキャッシュの統計を出力してキャッシュを捨てる
+func (s *server) flush(logger echo.Logger) {
+	lowPriced := s.lowPricedEstates.stats()
+	reco := s.recommendedEstates.stats()
+	logger.Infof("cache stats: lowPricedEstate hits=%v misses=%v, recommendedEstate hits=%v misses=%v",
+		lowPriced.Hits, lowPriced.Misses, reco.Hits, reco.Misses)
+
+	s.lowPricedEstates.clear()
+	s.recommendedEstates.clear()
+}
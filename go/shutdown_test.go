@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// blockingChairStore BuyChair の途中で止まる椅子の保存先。release が閉じられるまで書き込まずに待つ
+// コンテキストが取り消されたら何も書き込まずに戻るので、ロールバックしたトランザクションと同じ状態になる
+type blockingChairStore struct {
+	*memoryChairStore
+	entered  chan struct{}
+	release  chan struct{}
+	returned chan error
+}
+
+func (s *blockingChairStore) BuyChair(ctx context.Context, id int64, email string) (*Order, error) {
+	close(s.entered)
+	select {
+	case <-s.release:
+		order, err := s.memoryChairStore.BuyChair(ctx, id, email)
+		s.returned <- err
+		return order, err
+	case <-ctx.Done():
+		s.returned <- ctx.Err()
+		return nil, ctx.Err()
+	}
+}
+
+// startBlockingServer 椅子 1 を在庫 1 で登録したサーバーを起動し、購入のリクエストを送って BuyChair で止まるのを待つ
+func startBlockingServer(t *testing.T) (*server, *echo.Echo, *blockingChairStore, chan int) {
+	t.Helper()
+	s, e := newTestServer(t)
+	e.HideBanner = true
+	store := &blockingChairStore{
+		memoryChairStore: newMemoryChairStore(),
+		entered:          make(chan struct{}),
+		release:          make(chan struct{}),
+		returned:         make(chan error, 1),
+	}
+	importer, _ := store.ImportChairs(context.Background(), ImportInsert)
+	if err := importer.Write(context.Background(), []Chair{{ID: 1, Price: 1000, Stock: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := importer.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.chairs = store
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Listener = l
+	go e.Start("")
+
+	status := make(chan int, 1)
+	go func() {
+		res, err := http.Post("http://"+l.Addr().String()+"/api/chair/buy/1", echo.MIMEApplicationJSON, strings.NewReader(`{"email":"a@example.com"}`))
+		if err != nil {
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+
+	select {
+	case <-store.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("buyChair did not reach the store")
+	}
+	return s, e, store, status
+}
+
+func chairStockAndOrders(t *testing.T, store *blockingChairStore) (int64, int64) {
+	t.Helper()
+	chair, err := store.memoryChairStore.GetChair(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, _, err := store.memoryChairStore.OrdersByChair(context.Background(), 1, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chair.Stock, count
+}
+
+func TestShutdownDrainsInFlightPurchase(t *testing.T) {
+	s, e, store, status := startBlockingServer(t)
+
+	done := make(chan struct{})
+	go func() {
+		s.shutdown(e, 2*time.Second)
+		close(done)
+	}()
+	// 終了を始めてから購入を進める
+	time.Sleep(50 * time.Millisecond)
+	close(store.release)
+	<-done
+
+	if err := <-store.returned; err != nil {
+		t.Fatalf("BuyChair returned %v", err)
+	}
+	if code := <-status; code != http.StatusOK {
+		t.Fatalf("status = %v, want %v", code, http.StatusOK)
+	}
+	if stock, orders := chairStockAndOrders(t, store); stock != 0 || orders != 1 {
+		t.Fatalf("stock = %v, orders = %v after drained purchase, want 0 and 1", stock, orders)
+	}
+}
+
+func TestShutdownCancelsPurchasePastDeadline(t *testing.T) {
+	s, e, store, status := startBlockingServer(t)
+
+	s.shutdown(e, 100*time.Millisecond)
+
+	select {
+	case err := <-store.returned:
+		if err != context.Canceled {
+			t.Fatalf("BuyChair returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request context was not cancelled after the shutdown deadline")
+	}
+	if code := <-status; code == http.StatusOK {
+		t.Fatal("cancelled purchase reported success")
+	}
+	if stock, orders := chairStockAndOrders(t, store); stock != 1 || orders != 0 {
+		t.Fatalf("stock = %v, orders = %v after cancelled purchase, want 1 and 0", stock, orders)
+	}
+}
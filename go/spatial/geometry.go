@@ -0,0 +1,76 @@
+package spatial
+
+import "math"
+
+// Point 緯度経度で表される点
+type Point struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// Rect 緯度経度が共に最小になる点 Min と最大になる点 Max で表される矩形
+type Rect struct {
+	Min Point
+	Max Point
+}
+
+// Contains 点が矩形の内部 (境界を含む) にあるかを判定する
+func (r Rect) Contains(p Point) bool {
+	return r.Min.Latitude <= p.Latitude && p.Latitude <= r.Max.Latitude &&
+		r.Min.Longitude <= p.Longitude && p.Longitude <= r.Max.Longitude
+}
+
+// Polygon 頂点を順に並べた多角形。始点と終点は同じでも異なっていてもよい
+type Polygon []Point
+
+// Bounds 多角形を囲む最小の矩形を返す
+func (pg Polygon) Bounds() Rect {
+	if len(pg) == 0 {
+		return Rect{}
+	}
+	r := Rect{Min: pg[0], Max: pg[0]}
+	for _, p := range pg[1:] {
+		r.Min.Latitude = math.Min(r.Min.Latitude, p.Latitude)
+		r.Min.Longitude = math.Min(r.Min.Longitude, p.Longitude)
+		r.Max.Latitude = math.Max(r.Max.Latitude, p.Latitude)
+		r.Max.Longitude = math.Max(r.Max.Longitude, p.Longitude)
+	}
+	return r
+}
+
+// Contains 点が多角形の内部にあるかを判定する
+// ST_Contains と同じく、辺や頂点の上にある点は内部とみなさない
+func (pg Polygon) Contains(p Point) bool {
+	n := len(pg)
+	if n < 3 {
+		return false
+	}
+
+	inside := false
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		a, b := pg[i], pg[j]
+		if onSegment(a, b, p) {
+			return false
+		}
+		// p から経度方向に伸ばした半直線が辺 ab と交差する回数を数える
+		if (a.Longitude > p.Longitude) != (b.Longitude > p.Longitude) {
+			lat := (b.Latitude-a.Latitude)*(p.Longitude-a.Longitude)/(b.Longitude-a.Longitude) + a.Latitude
+			if p.Latitude < lat {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// onSegment 点 p が線分 ab 上にあるかを判定する
+func onSegment(a, b, p Point) bool {
+	cross := (b.Latitude-a.Latitude)*(p.Longitude-a.Longitude) - (b.Longitude-a.Longitude)*(p.Latitude-a.Latitude)
+	if cross != 0 {
+		return false
+	}
+	return Rect{
+		Min: Point{Latitude: math.Min(a.Latitude, b.Latitude), Longitude: math.Min(a.Longitude, b.Longitude)},
+		Max: Point{Latitude: math.Max(a.Latitude, b.Latitude), Longitude: math.Max(a.Longitude, b.Longitude)},
+	}.Contains(p)
+}
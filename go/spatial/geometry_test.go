@@ -0,0 +1,135 @@
+package spatial
+
+import "testing"
+
+// pt 緯度、経度の順で点を作る
+func pt(lat, lon float64) Point {
+	return Point{Latitude: lat, Longitude: lon}
+}
+
+func TestPolygonContains(t *testing.T) {
+	square := Polygon{pt(0, 0), pt(0, 10), pt(10, 10), pt(10, 0)}
+	// 凹型の U 字。緯度 4 から 10、経度 4 から 6 の切り欠きは外側
+	concave := Polygon{pt(0, 0), pt(0, 10), pt(10, 10), pt(10, 6), pt(4, 6), pt(4, 4), pt(10, 4), pt(10, 0)}
+	// 二つの正方形が頂点 (5, 5) で接している自己接触した多角形
+	selfTouching := Polygon{pt(0, 0), pt(0, 5), pt(5, 5), pt(10, 5), pt(10, 10), pt(5, 10), pt(5, 5), pt(5, 0)}
+	// 辺の途中に頂点がある正方形
+	collinear := Polygon{pt(0, 0), pt(0, 5), pt(0, 10), pt(10, 10), pt(10, 0)}
+	// 頂点が経度方向の真上にある菱形。半直線が頂点をちょうど通る
+	diamond := Polygon{pt(0, 5), pt(5, 10), pt(10, 5), pt(5, 0)}
+
+	tests := []struct {
+		name    string
+		polygon Polygon
+		point   Point
+		want    bool
+	}{
+		{"inside", square, pt(5, 5), true},
+		{"outside", square, pt(11, 5), false},
+		{"outside beside", square, pt(5, -1), false},
+		{"on edge", square, pt(0, 5), false},
+		{"on opposite edge", square, pt(10, 5), false},
+		{"on vertex", square, pt(10, 10), false},
+		{"on origin vertex", square, pt(0, 0), false},
+		{"closed ring", append(square, square[0]), pt(5, 5), true},
+		{"closed ring on vertex", append(square, square[0]), pt(0, 0), false},
+
+		{"horizontal edge inside", square, pt(5, 0.0001), true},
+		{"level with horizontal edge outside", square, pt(-1, 0), false},
+		{"ray through vertex inside", diamond, pt(3, 5), true},
+		{"ray through vertex outside", diamond, pt(-1, 5), false},
+		{"ray through vertex beyond", diamond, pt(11, 5), false},
+		{"diamond on vertex", diamond, pt(10, 5), false},
+
+		{"concave left arm", concave, pt(7, 2), true},
+		{"concave right arm", concave, pt(7, 8), true},
+		{"concave base", concave, pt(2, 5), true},
+		{"concave notch", concave, pt(7, 5), false},
+		{"concave notch edge", concave, pt(4, 5), false},
+		{"concave inner vertex", concave, pt(4, 4), false},
+
+		{"self touching first square", selfTouching, pt(2, 2), true},
+		{"self touching second square", selfTouching, pt(7, 7), true},
+		{"self touching gap", selfTouching, pt(2, 7), false},
+		{"self touching point", selfTouching, pt(5, 5), false},
+
+		{"collinear inside", collinear, pt(5, 5), true},
+		{"collinear middle vertex", collinear, pt(0, 5), false},
+		{"collinear outside", collinear, pt(-1, 5), false},
+
+		{"empty", Polygon{}, pt(0, 0), false},
+		{"one point", Polygon{pt(0, 0)}, pt(0, 0), false},
+		{"two points", Polygon{pt(0, 0), pt(10, 10)}, pt(5, 5), false},
+		{"zero area", Polygon{pt(0, 0), pt(5, 5), pt(10, 10)}, pt(5, 5), false},
+		{"zero area off line", Polygon{pt(0, 0), pt(5, 5), pt(10, 10)}, pt(5, 6), false},
+		{"repeated points", Polygon{pt(0, 0), pt(0, 0), pt(0, 0)}, pt(0, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.polygon.Contains(tt.point); got != tt.want {
+				t.Errorf("Contains(%v) = %v, want %v", tt.point, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolygonBounds(t *testing.T) {
+	pg := Polygon{pt(3, 1), pt(-2, 5), pt(4, -1)}
+	want := Rect{Min: pt(-2, -1), Max: pt(4, 5)}
+	if got := pg.Bounds(); got != want {
+		t.Errorf("Bounds() = %v, want %v", got, want)
+	}
+	if got := (Polygon{}).Bounds(); got != (Rect{}) {
+		t.Errorf("Bounds() of empty polygon = %v", got)
+	}
+}
+
+func TestSearchPolygonOrderAndLimit(t *testing.T) {
+	ix := New(1)
+	ix.Reset([]Item{
+		{ID: 1, Point: pt(1, 1), Popularity: 10},
+		{ID: 2, Point: pt(2, 2), Popularity: 30},
+		{ID: 3, Point: pt(3, 3), Popularity: 30},
+		{ID: 4, Point: pt(4, 4), Popularity: 20},
+		// 多角形の外と辺の上の物件は含まない
+		{ID: 5, Point: pt(20, 20), Popularity: 100},
+		{ID: 6, Point: pt(0, 5), Popularity: 100},
+	})
+	square := Polygon{pt(0, 0), pt(0, 10), pt(10, 10), pt(10, 0)}
+
+	tests := []struct {
+		limit int
+		want  []int64
+	}{
+		{0, []int64{2, 3, 4, 1}},
+		{10, []int64{2, 3, 4, 1}},
+		{3, []int64{2, 3, 4}},
+		{1, []int64{2}},
+	}
+	for _, tt := range tests {
+		got := ids(ix.SearchPolygon(square, tt.limit))
+		if !equalIDs(got, tt.want) {
+			t.Errorf("SearchPolygon(limit=%v) = %v, want %v", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func ids(items []Item) []int64 {
+	ids := make([]int64, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	return ids
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
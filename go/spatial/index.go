@@ -0,0 +1,200 @@
+// Package spatial 物件の座標をメモリ上に保持し、矩形や多角形による検索を行う
+package spatial
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// Item インデックスに載せる物件の情報
+// 検索結果を popularity DESC, id ASC で返すために Popularity も持つ
+type Item struct {
+	ID         int64
+	Point      Point
+	Popularity int64
+}
+
+type cellKey struct {
+	lat int64
+	lon int64
+}
+
+// Index 緯度経度を一定の幅で区切ったグリッドで物件を管理する
+type Index struct {
+	mu       sync.RWMutex
+	cellSize float64
+	cells    map[cellKey][]Item
+	items    map[int64]Item
+}
+
+// New 一辺が cellSize 度のグリッドを使うインデックスを作る
+func New(cellSize float64) *Index {
+	return &Index{
+		cellSize: cellSize,
+		cells:    map[cellKey][]Item{},
+		items:    map[int64]Item{},
+	}
+}
+
+func (ix *Index) keyOf(p Point) cellKey {
+	return cellKey{
+		lat: int64(math.Floor(p.Latitude / ix.cellSize)),
+		lon: int64(math.Floor(p.Longitude / ix.cellSize)),
+	}
+}
+
+// Reset インデックスの中身を items で置き換える
+func (ix *Index) Reset(items []Item) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.cells = make(map[cellKey][]Item, len(ix.cells))
+	ix.items = make(map[int64]Item, len(items))
+	for _, item := range items {
+		ix.insert(item)
+	}
+}
+
+// Insert items を追加する。同じ ID が既にあれば置き換える
+func (ix *Index) Insert(items ...Item) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	for _, item := range items {
+		ix.insert(item)
+	}
+}
+
+// Remove ids の物件を取り除く。ない ID は無視する
+func (ix *Index) Remove(ids ...int64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	for _, id := range ids {
+		if item, ok := ix.items[id]; ok {
+			ix.remove(item)
+		}
+	}
+}
+
+func (ix *Index) insert(item Item) {
+	if old, ok := ix.items[item.ID]; ok {
+		ix.remove(old)
+	}
+	key := ix.keyOf(item.Point)
+	ix.cells[key] = append(ix.cells[key], item)
+	ix.items[item.ID] = item
+}
+
+func (ix *Index) remove(item Item) {
+	key := ix.keyOf(item.Point)
+	cell := ix.cells[key]
+	for i := range cell {
+		if cell[i].ID == item.ID {
+			cell = append(cell[:i], cell[i+1:]...)
+			break
+		}
+	}
+	if len(cell) == 0 {
+		delete(ix.cells, key)
+	} else {
+		ix.cells[key] = cell
+	}
+	delete(ix.items, item.ID)
+}
+
+// Get id の物件を返す
+func (ix *Index) Get(id int64) (Item, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	item, ok := ix.items[id]
+	return item, ok
+}
+
+// Len インデックスに載っている物件の数を返す
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	return len(ix.items)
+}
+
+// IDs インデックスに載っている物件の ID を全て返す
+func (ix *Index) IDs() []int64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	ids := make([]int64, 0, len(ix.items))
+	for id := range ix.items {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Search 矩形 r の内部 (境界を含む) にある物件を popularity DESC, id ASC の順で返す
+func (ix *Index) Search(r Rect) []Item {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	found := make([]Item, 0)
+	ix.scan(r, func(item Item) {
+		found = append(found, item)
+	})
+	sortItems(found)
+	return found
+}
+
+// SearchPolygon 多角形 pg の内部にある物件を popularity DESC, id ASC の順に最大 limit 件返す
+// limit が 0 以下なら全件返す
+func (ix *Index) SearchPolygon(pg Polygon, limit int) []Item {
+	candidates := ix.Search(pg.Bounds())
+
+	found := make([]Item, 0)
+	for _, item := range candidates {
+		if !pg.Contains(item.Point) {
+			continue
+		}
+		found = append(found, item)
+		if limit > 0 && len(found) >= limit {
+			break
+		}
+	}
+	return found
+}
+
+// scan r と重なるセルを走査する。r が広すぎる場合は全セルを走査する
+func (ix *Index) scan(r Rect, fn func(Item)) {
+	cells := (math.Floor(r.Max.Latitude/ix.cellSize) - math.Floor(r.Min.Latitude/ix.cellSize) + 1) *
+		(math.Floor(r.Max.Longitude/ix.cellSize) - math.Floor(r.Min.Longitude/ix.cellSize) + 1)
+	if !(cells <= float64(len(ix.cells))) {
+		for _, cell := range ix.cells {
+			scanCell(cell, r, fn)
+		}
+		return
+	}
+	lo, hi := ix.keyOf(r.Min), ix.keyOf(r.Max)
+	for lat := lo.lat; lat <= hi.lat; lat++ {
+		for lon := lo.lon; lon <= hi.lon; lon++ {
+			scanCell(ix.cells[cellKey{lat: lat, lon: lon}], r, fn)
+		}
+	}
+}
+
+func scanCell(cell []Item, r Rect, fn func(Item)) {
+	for _, item := range cell {
+		if r.Contains(item.Point) {
+			fn(item)
+		}
+	}
+}
+
+func sortItems(items []Item) {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Popularity != items[j].Popularity {
+			return items[i].Popularity > items[j].Popularity
+		}
+		return items[i].ID < items[j].ID
+	})
+}
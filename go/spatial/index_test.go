@@ -0,0 +1,212 @@
+package spatial
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// randomItems 東京付近に n 件の物件をばらまく。popularity は重なるようにする
+func randomItems(r *rand.Rand, n int) []Item {
+	items := make([]Item, 0, n)
+	for i := 0; i < n; i++ {
+		items = append(items, Item{
+			ID:         int64(i + 1),
+			Point:      pt(35+r.Float64(), 139+r.Float64()),
+			Popularity: int64(r.Intn(1000)),
+		})
+	}
+	return items
+}
+
+// randomPolygon 中心の周りに頂点を角度順に並べた、凹みのある多角形を作る
+func randomPolygon(r *rand.Rand) Polygon {
+	center := pt(35+r.Float64(), 139+r.Float64())
+	n := 3 + r.Intn(10)
+	angles := make([]float64, 0, n)
+	for i := 0; i < n; i++ {
+		angles = append(angles, r.Float64()*2*math.Pi)
+	}
+	sort.Float64s(angles)
+	pg := make(Polygon, 0, n)
+	for _, a := range angles {
+		radius := 0.02 + r.Float64()*0.3
+		pg = append(pg, pt(center.Latitude+radius*math.Sin(a), center.Longitude+radius*math.Cos(a)))
+	}
+	return pg
+}
+
+func randomRect(r *rand.Rand) Rect {
+	a, b := pt(35+r.Float64(), 139+r.Float64()), pt(35+r.Float64(), 139+r.Float64())
+	return Rect{
+		Min: pt(math.Min(a.Latitude, b.Latitude), math.Min(a.Longitude, b.Longitude)),
+		Max: pt(math.Max(a.Latitude, b.Latitude), math.Max(a.Longitude, b.Longitude)),
+	}
+}
+
+// scanRect, scanPolygon インデックスを使わずに全件を調べる。以前の SQL による範囲検索と同じ結果になる
+func scanRect(items map[int64]Item, r Rect) []Item {
+	found := make([]Item, 0)
+	for _, item := range items {
+		if r.Contains(item.Point) {
+			found = append(found, item)
+		}
+	}
+	sortItems(found)
+	return found
+}
+
+func scanPolygon(items map[int64]Item, pg Polygon, limit int) []Item {
+	found := make([]Item, 0)
+	for _, item := range scanRect(items, pg.Bounds()) {
+		if pg.Contains(item.Point) {
+			found = append(found, item)
+		}
+	}
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
+
+func equalItems(a, b []Item) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestIndexMatchesScan(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	items := randomItems(r, 5000)
+	all := make(map[int64]Item, len(items))
+	for _, item := range items {
+		all[item.ID] = item
+	}
+	ix := New(0.05)
+	ix.Reset(items)
+
+	check := func(step string) {
+		t.Helper()
+		if ix.Len() != len(all) {
+			t.Fatalf("%v: Len() = %v, want %v", step, ix.Len(), len(all))
+		}
+		for i := 0; i < 100; i++ {
+			rect := randomRect(r)
+			if got, want := ix.Search(rect), scanRect(all, rect); !equalItems(got, want) {
+				t.Fatalf("%v: Search(%v) returned %v items, want %v", step, rect, len(got), len(want))
+			}
+			pg := randomPolygon(r)
+			for _, limit := range []int{0, 50} {
+				if got, want := ix.SearchPolygon(pg, limit), scanPolygon(all, pg, limit); !equalItems(got, want) {
+					t.Fatalf("%v: SearchPolygon(%v, %v) = %v, want %v", step, pg, limit, ids(got), ids(want))
+				}
+			}
+		}
+	}
+	check("reset")
+
+	// 移動と追加と削除の後も一致する
+	updates := make([]Item, 0)
+	for id := int64(1); id <= 500; id++ {
+		item := Item{ID: id, Point: pt(35+r.Float64(), 139+r.Float64()), Popularity: int64(r.Intn(1000))}
+		updates = append(updates, item)
+		all[id] = item
+	}
+	for _, item := range randomItems(r, 300) {
+		item.ID += 10000
+		updates = append(updates, item)
+		all[item.ID] = item
+	}
+	ix.Insert(updates...)
+	check("insert")
+
+	removed := []int64{}
+	for id := int64(600); id < 900; id++ {
+		removed = append(removed, id)
+		delete(all, id)
+	}
+	ix.Remove(append(removed, 99999)...)
+	check("remove")
+}
+
+// 全体を一つのセルに入れても、極端に細かいセルでも結果は変わらない
+func TestIndexCellSizeDoesNotChangeResults(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	items := randomItems(r, 1000)
+	all := make(map[int64]Item, len(items))
+	for _, item := range items {
+		all[item.ID] = item
+	}
+	for _, cellSize := range []float64{10, 0.001} {
+		ix := New(cellSize)
+		ix.Reset(items)
+		for i := 0; i < 50; i++ {
+			pg := randomPolygon(r)
+			if got, want := ix.SearchPolygon(pg, 0), scanPolygon(all, pg, 0); !equalItems(got, want) {
+				t.Fatalf("cellSize %v: SearchPolygon returned %v items, want %v", cellSize, len(got), len(want))
+			}
+		}
+	}
+}
+
+// benchmarkData ベンチマークで使う 3 万件の物件と 100 個の多角形
+func benchmarkData() ([]Item, []Polygon) {
+	r := rand.New(rand.NewSource(3))
+	items := randomItems(r, 30000)
+	polygons := make([]Polygon, 0, 100)
+	for i := 0; i < 100; i++ {
+		polygons = append(polygons, randomPolygon(r))
+	}
+	return items, polygons
+}
+
+func BenchmarkIndexSearchPolygon(b *testing.B) {
+	items, polygons := benchmarkData()
+	ix := New(0.05)
+	ix.Reset(items)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ix.SearchPolygon(polygons[i%len(polygons)], 50)
+	}
+}
+
+// BenchmarkScanSearchPolygon 以前の SQL の経路と同じく、外接矩形に入る物件を全件から探してから多角形で絞り込む
+func BenchmarkScanSearchPolygon(b *testing.B) {
+	items, polygons := benchmarkData()
+	all := make(map[int64]Item, len(items))
+	for _, item := range items {
+		all[item.ID] = item
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		scanPolygon(all, polygons[i%len(polygons)], 50)
+	}
+}
+
+func BenchmarkIndexSearch(b *testing.B) {
+	items, polygons := benchmarkData()
+	ix := New(0.05)
+	ix.Reset(items)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ix.Search(polygons[i%len(polygons)].Bounds())
+	}
+}
+
+func BenchmarkIndexInsert(b *testing.B) {
+	items, _ := benchmarkData()
+	ix := New(0.05)
+	ix.Reset(items)
+	r := rand.New(rand.NewSource(4))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ix.Insert(Item{ID: int64(i%len(items) + 1), Point: pt(35+r.Float64(), 139+r.Float64())})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// runSQLScripts paths の SQL ファイルを順に db 上で実行する
+// USE などの影響が次の文に引き継がれるよう、全ての文を同じコネクションで実行する
+func runSQLScripts(ctx context.Context, db *sqlx.DB, logger echo.Logger, paths []string) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	for _, p := range paths {
+		start := time.Now()
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return fmt.Errorf("failed to read %v: %w", p, err)
+		}
+		statements, err := splitSQLStatements(string(b))
+		if err != nil {
+			return fmt.Errorf("failed to parse %v: %w", p, err)
+		}
+		for i, stmt := range statements {
+			if _, err := conn.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("%v: statement %v: %w", filepath.Base(p), i+1, err)
+			}
+		}
+		logger.Infof("executed %v (%v statements) in %v", filepath.Base(p), len(statements), time.Since(start))
+	}
+	return nil
+}
+
+// splitSQLStatements SQL スクリプトを ; で文に分ける
+// 文字列リテラルや識別子、コメントの中の ; では区切らず、コメントは取り除く
+// /*! ... */ は MySQL が文として実行するコメントなので、そのまま残す
+func splitSQLStatements(script string) ([]string, error) {
+	statements := make([]string, 0)
+	var stmt strings.Builder
+	flush := func() {
+		if s := strings.TrimSpace(stmt.String()); s != "" {
+			statements = append(statements, s)
+		}
+		stmt.Reset()
+	}
+
+	for i := 0; i < len(script); i++ {
+		ch := script[i]
+		switch {
+		case ch == '\'' || ch == '"' || ch == '`':
+			end, err := skipQuoted(script, i)
+			if err != nil {
+				return nil, err
+			}
+			stmt.WriteString(script[i : end+1])
+			i = end
+		case ch == '#' || isDashComment(script[i:]):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end
+				stmt.WriteByte('\n')
+			}
+		case ch == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment at offset %v", i)
+			}
+			if strings.HasPrefix(script[i:], "/*!") {
+				stmt.WriteString(script[i : i+end+4])
+			} else {
+				stmt.WriteByte(' ')
+			}
+			i += end + 3
+		case ch == ';':
+			flush()
+		default:
+			stmt.WriteByte(ch)
+		}
+	}
+	flush()
+	return statements, nil
+}
+
+// skipQuoted script[start] から始まる引用符の閉じ位置を返す
+func skipQuoted(script string, start int) (int, error) {
+	quote := script[start]
+	for i := start + 1; i < len(script); i++ {
+		switch script[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			// '' のように重ねた引用符は閉じではない
+			if i+1 < len(script) && script[i+1] == quote {
+				i++
+				continue
+			}
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated %c at offset %v", quote, start)
+}
+
+// isDashComment s が -- コメントで始まるかを判定する。MySQL では -- の後に空白か制御文字が必要
+func isDashComment(s string) bool {
+	return strings.HasPrefix(s, "--") && (len(s) == 2 || s[2] <= ' ')
+}
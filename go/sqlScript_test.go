@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitSQLStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{"plain", "SELECT 1;\nSELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{"no trailing semicolon", "SELECT 1; SELECT 2", []string{"SELECT 1", "SELECT 2"}},
+		{"empty statements", ";;\n  ;SELECT 1;;", []string{"SELECT 1"}},
+		{"single quotes", "SELECT 'a;b'; SELECT 2", []string{"SELECT 'a;b'", "SELECT 2"}},
+		{"double quotes", `SELECT "a;b"; SELECT 2`, []string{`SELECT "a;b"`, "SELECT 2"}},
+		{"backticks", "SELECT `a;b` FROM t; SELECT 2", []string{"SELECT `a;b` FROM t", "SELECT 2"}},
+		{"doubled single quote", "SELECT 'it''s;'; SELECT 2", []string{"SELECT 'it''s;'", "SELECT 2"}},
+		{"doubled double quote", `SELECT "say ""hi;"""; SELECT 2`, []string{`SELECT "say ""hi;"""`, "SELECT 2"}},
+		{"doubled backtick", "SELECT `a``;b`; SELECT 2", []string{"SELECT `a``;b`", "SELECT 2"}},
+		{"backslash escaped quote", `SELECT 'a\';b'; SELECT 2`, []string{`SELECT 'a\';b'`, "SELECT 2"}},
+		{"backslash escaped backslash", `SELECT 'a\\'; SELECT 2`, []string{`SELECT 'a\\'`, "SELECT 2"}},
+		{"backslash in backticks", "SELECT `a\\`; SELECT 2", []string{"SELECT `a\\`", "SELECT 2"}},
+		{"other quotes inside", `SELECT '"` + "`" + `;'; SELECT 2`, []string{`SELECT '"` + "`" + `;'`, "SELECT 2"}},
+		{"dash comment", "SELECT 1; -- a; b\nSELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{"dash comment at end", "SELECT 1; --", []string{"SELECT 1"}},
+		{"dash comment inside statement", "SELECT 1 -- ;\n+ 1;", []string{"SELECT 1 \n+ 1"}},
+		{"dashes without space", "SELECT 1--1;", []string{"SELECT 1--1"}},
+		{"hash comment", "# setup; here\nSELECT 1;", []string{"SELECT 1"}},
+		{"comment markers in strings", "SELECT '-- x', '# y', '/* z */';", []string{"SELECT '-- x', '# y', '/* z */'"}},
+		{"block comment", "SELECT /* ; */ 1;", []string{"SELECT   1"}},
+		{"multiline block comment", "/*\n a;\n b;\n*/\nSELECT 1;", []string{"SELECT 1"}},
+		{"executable comment", "/*!40101 SET NAMES utf8mb4 */;\nSELECT 1;", []string{"/*!40101 SET NAMES utf8mb4 */", "SELECT 1"}},
+		{"executable comment inside statement", "CREATE TABLE t (id INT) /*!50100 ENGINE=InnoDB */;", []string{"CREATE TABLE t (id INT) /*!50100 ENGINE=InnoDB */"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitSQLStatements(tt.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("splitSQLStatements(%q) = %q, want %q", tt.script, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitSQLStatementsRejectsUnterminated(t *testing.T) {
+	for _, script := range []string{
+		"SELECT 'a;",
+		`SELECT "a`,
+		"SELECT `a",
+		`SELECT 'a\'`,
+		"SELECT 1 /* ;",
+		"/*! SET NAMES utf8mb4",
+	} {
+		if got, err := splitSQLStatements(script); err == nil {
+			t.Errorf("splitSQLStatements(%q) = %q, want an error", script, got)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/isucon/isucon10-qualify/isuumo/spatial"
+)
+
+// ErrNotFound 指定された椅子や物件が存在しない (椅子の場合は在庫がない) ことを表す
+var ErrNotFound = errors.New("not found")
+
+// ErrDuplicateDocumentRequest 同じメールアドレスから同じ物件への資料請求が短い間に重なったことを表す
+var ErrDuplicateDocumentRequest = errors.New("duplicate document request")
+
+// ErrInvalidStatusTransition 資料請求の状態をその順に進められないことを表す
+var ErrInvalidStatusTransition = errors.New("invalid status transition")
+
+// ErrInvalidReservation 取り置きが存在しないか、期限切れか、別の椅子のものであることを表す
+var ErrInvalidReservation = errors.New("reservation is invalid or expired")
+
+// dbTime 購入記録などに残す時刻。DATETIME(6) の列に合わせてマイクロ秒に丸める
+func dbTime() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// ChairImporter 一つのトランザクションで椅子を少しずつ書き込む取り込み
+type ChairImporter interface {
+	// Write chairs を書き込む。chairs は呼び出しの後で使い回してよい
+	// insert モードで既にある ID があればこの chairs は書き込まずに *DuplicateIDError を返す
+	Write(ctx context.Context, chairs []Chair) error
+	// Commit 書き込みを確定して全体の件数を返す。replace モードでは書き込まなかった椅子をここで削除する
+	Commit(ctx context.Context) (ImportSummary, error)
+	// Rollback 書き込みを取り消す。Commit の後に呼んでも何もしない
+	Rollback() error
+}
+
+// EstateImporter 一つのトランザクションで物件を少しずつ書き込む取り込み
+type EstateImporter interface {
+	// Write estates を書き込む。estates は呼び出しの後で使い回してよい
+	// insert モードで既にある ID があればこの estates は書き込まずに *DuplicateIDError を返す
+	Write(ctx context.Context, estates []Estate) error
+	// Commit 書き込みを確定して全体の件数を返す。replace モードでは書き込まなかった物件をここで削除する
+	Commit(ctx context.Context) (ImportSummary, error)
+	// Rollback 書き込みを取り消す。Commit の後に呼んでも何もしない
+	Rollback() error
+}
+
+// ChairStore 椅子の保存先
+type ChairStore interface {
+	// Initialize 保存先を初期データの状態に戻す
+	Initialize(ctx context.Context) error
+	// GetChair id の椅子を在庫の有無に関わらず返す
+	GetChair(ctx context.Context, id int64) (*Chair, error)
+	// ImportChairs mode に従って椅子を少しずつ書き込む取り込みを始める。Commit するまで何も反映しない
+	ImportChairs(ctx context.Context, mode ImportMode) (ChairImporter, error)
+	// ExportChairs 在庫の有無に関わらず条件に合う椅子を id ASC で一件ずつ fn に渡す。ページ指定は使わない
+	ExportChairs(ctx context.Context, q ChairSearchQuery, fn func(Chair) error) error
+	// SearchChairs 在庫のある椅子から条件に合うものを popularity DESC, id ASC で返す
+	SearchChairs(ctx context.Context, q ChairSearchQuery) (int64, []Chair, error)
+	// LowPricedChairs 在庫のある椅子を price ASC, id ASC で limit 件返す
+	LowPricedChairs(ctx context.Context, limit int) ([]Chair, error)
+	// BuyChair 在庫を一つ減らし、同じトランザクションで email の購入記録を残す。在庫がなければ ErrNotFound を返す
+	BuyChair(ctx context.Context, id int64, email string) (*Order, error)
+	// ReserveChair 在庫を一つ減らして r として取り置く。在庫がなければ ErrNotFound を返す
+	ReserveChair(ctx context.Context, r Reservation) error
+	// BuyReservedChair 取り置いた椅子を購入する。取り置きが使えなければ ErrInvalidReservation を返す
+	BuyReservedChair(ctx context.Context, token string, id int64, email string) (*Order, error)
+	// ReleaseExpiredReservations now までに期限が切れた取り置きを在庫に戻し、戻した数を返す
+	ReleaseExpiredReservations(ctx context.Context, now time.Time) (int, error)
+	// Checkout cart の椅子をまとめて購入する。在庫が足りない椅子があれば何も購入せず *InsufficientStockError を返す
+	// cart は normalizeCart で chairId の昇順に並べておく
+	Checkout(ctx context.Context, email string, cart []CartItem) ([]Order, error)
+	// OrdersByEmail email の購入記録を新しい順に返す
+	OrdersByEmail(ctx context.Context, email string, page, perPage int) (int64, []Order, error)
+	// OrdersByChair 椅子 chairID の購入記録を新しい順に返す
+	OrdersByChair(ctx context.Context, chairID int64, page, perPage int) (int64, []Order, error)
+}
+
+// EstateStore 物件の保存先
+type EstateStore interface {
+	// Initialize 保存先を初期データの状態に戻す
+	Initialize(ctx context.Context) error
+	// GetEstate id の物件を返す
+	GetEstate(ctx context.Context, id int64) (*Estate, error)
+	// ImportEstates mode に従って物件を少しずつ書き込む取り込みを始める。Commit するまで何も反映しない
+	ImportEstates(ctx context.Context, mode ImportMode) (EstateImporter, error)
+	// ExportEstates 条件に合う物件を id ASC で一件ずつ fn に渡す。ページ指定は使わない
+	ExportEstates(ctx context.Context, q EstateSearchQuery, fn func(Estate) error) error
+	// SearchEstates 条件に合う物件を popularity DESC, id ASC で返す
+	SearchEstates(ctx context.Context, q EstateSearchQuery) (int64, []Estate, error)
+	// LowPricedEstates 物件を rent ASC, id ASC で limit 件返す
+	LowPricedEstates(ctx context.Context, limit int) ([]Estate, error)
+	// RecommendedEstates 幅 w, 高さ h, 奥行き d の椅子が入る物件を popularity DESC, id ASC で limit 件返す
+	RecommendedEstates(ctx context.Context, w, h, d int64, limit int) ([]Estate, error)
+	// SearchEstatesInPolygon 多角形の内部にある物件を popularity DESC, id ASC で limit 件返す
+	SearchEstatesInPolygon(ctx context.Context, polygon spatial.Polygon, limit int) ([]Estate, error)
+	// CreateDocumentRequest estateID の物件への email からの資料請求を記録する
+	// since 以降に同じ資料請求があれば ErrDuplicateDocumentRequest を返す
+	CreateDocumentRequest(ctx context.Context, estateID int64, email string, since time.Time) (*DocumentRequest, error)
+	// DocumentRequests 条件に合う資料請求を新しい順に返す
+	DocumentRequests(ctx context.Context, q DocumentRequestQuery) (int64, []DocumentRequest, error)
+	// UpdateDocumentRequestStatus 資料請求の状態を status に進める。進められなければ ErrInvalidStatusTransition を返す
+	UpdateDocumentRequestStatus(ctx context.Context, id int64, status string) (*DocumentRequest, error)
+}
+
+// ChairSearchQuery 椅子の検索条件。空の条件は絞り込みに使わない
+type ChairSearchQuery struct {
+	PriceRangeIDs  []int64
+	HeightRangeIDs []int64
+	WidthRangeIDs  []int64
+	DepthRangeIDs  []int64
+	Kinds          []string
+	Colors         []string
+	FeaturesMask   uint64
+	Page           int
+	PerPage        int
+}
+
+func (q ChairSearchQuery) empty() bool {
+	return len(q.PriceRangeIDs) == 0 && len(q.HeightRangeIDs) == 0 && len(q.WidthRangeIDs) == 0 && len(q.DepthRangeIDs) == 0 &&
+		len(q.Kinds) == 0 && len(q.Colors) == 0 && q.FeaturesMask == 0
+}
+
+// match 在庫のある椅子が検索条件に合うかを判定する
+func (q ChairSearchQuery) match(chair *Chair) bool {
+	return chair.Stock > 0 && q.matchFilters(chair)
+}
+
+// matchFilters 在庫の有無に関わらず椅子が検索条件に合うかを判定する
+func (q ChairSearchQuery) matchFilters(chair *Chair) bool {
+	return containsInt64(q.PriceRangeIDs, int64(getChairPriceId(int(chair.Price)))) &&
+		containsInt64(q.HeightRangeIDs, int64(getSizeId(int(chair.Height)))) &&
+		containsInt64(q.WidthRangeIDs, int64(getSizeId(int(chair.Width)))) &&
+		containsInt64(q.DepthRangeIDs, int64(getSizeId(int(chair.Depth)))) &&
+		containsString(q.Kinds, chair.Kind) &&
+		containsString(q.Colors, chair.Color) &&
+		chair.FeaturesMask&q.FeaturesMask == q.FeaturesMask
+}
+
+// Bounds 両端を含む値の範囲。-1 は上限(下限)なしを表す
+type Bounds struct {
+	Min int64
+	Max int64
+}
+
+var noBounds = Bounds{Min: -1, Max: -1}
+
+func (b Bounds) contains(v int64) bool {
+	return (b.Min < 0 || b.Min <= v) && (b.Max < 0 || v <= b.Max)
+}
+
+// EstateSearchQuery 物件の検索条件。空の条件は絞り込みに使わない
+type EstateSearchQuery struct {
+	DoorHeightRangeIDs []int64
+	DoorWidthRangeIDs  []int64
+	RentRangeIDs       []int64
+	DoorHeight         Bounds
+	DoorWidth          Bounds
+	Rent               Bounds
+	FeaturesMask       uint64
+	Page               int
+	PerPage            int
+}
+
+func (q EstateSearchQuery) empty() bool {
+	return len(q.DoorHeightRangeIDs) == 0 && len(q.DoorWidthRangeIDs) == 0 && len(q.RentRangeIDs) == 0 &&
+		q.DoorHeight == noBounds && q.DoorWidth == noBounds && q.Rent == noBounds && q.FeaturesMask == 0
+}
+
+// match 物件が検索条件に合うかを判定する
+func (q EstateSearchQuery) match(estate *Estate) bool {
+	return containsInt64(q.DoorHeightRangeIDs, int64(getSizeId(int(estate.DoorHeight)))) &&
+		containsInt64(q.DoorWidthRangeIDs, int64(getSizeId(int(estate.DoorWidth)))) &&
+		containsInt64(q.RentRangeIDs, int64(getRentPriceId(int(estate.Rent)))) &&
+		q.DoorHeight.contains(estate.DoorHeight) &&
+		q.DoorWidth.contains(estate.DoorWidth) &&
+		q.Rent.contains(estate.Rent) &&
+		estate.FeaturesMask&q.FeaturesMask == q.FeaturesMask
+}
+
+// fitsChair 幅 w, 高さ h, 奥行き d の椅子がいずれかの向きで物件のドアを通るかを判定する
+func (e *Estate) fitsChair(w, h, d int64) bool {
+	fits := func(a, b int64) bool {
+		return e.DoorWidth >= a && e.DoorHeight >= b
+	}
+	return fits(w, h) || fits(w, d) || fits(h, w) || fits(h, d) || fits(d, w) || fits(d, h)
+}
+
+// containsInt64 list が空か v を含むかを判定する
+func containsInt64(list []int64, v int64) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString list が空か v を含むかを判定する
+func containsString(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo"
+)
+
+// errUnsupportedUploadType アップロードの Content-Type が CSV のフォームでも NDJSON でもないことを表す
+var errUnsupportedUploadType = errors.New("unsupported upload content type")
+
+// isNDJSONUpload Content-Type が NDJSON (JSON Lines) なら true を、CSV を載せた multipart のフォームなら false を返す
+func isNDJSONUpload(c echo.Context) (bool, error) {
+	mediaType, _, err := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if err != nil {
+		return false, errUnsupportedUploadType
+	}
+	switch mediaType {
+	case "application/x-ndjson", "application/jsonl", "application/x-jsonlines":
+		return true, nil
+	case echo.MIMEMultipartForm:
+		return false, nil
+	}
+	return false, errUnsupportedUploadType
+}
+
+// readNDJSON リクエストの本文を一行ずつ読んで、行番号とともに row に渡す。空行は飛ばす
+// MaxRows 行か MaxBytes バイトを超えたら errUploadTooLarge を返す
+func (cfg csvImportConfig) readNDJSON(c echo.Context, row func(line int, data []byte) error) error {
+	req := c.Request()
+	if req.ContentLength > cfg.MaxBytes {
+		return errUploadTooLarge
+	}
+	r := bufio.NewReader(&limitedReader{r: req.Body, n: cfg.MaxBytes})
+	rows := 0
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			if rows >= cfg.MaxRows {
+				return errUploadTooLarge
+			}
+			rows++
+			if err := row(line, data); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// readChairs 椅子のアップロードを Content-Type に合わせて読み、一件ずつ検証して row に渡す
+func (cfg csvImportConfig) readChairs(c echo.Context, row func(line int, chair Chair, reasons []string)) error {
+	ndjson, err := isNDJSONUpload(c)
+	if err != nil {
+		return err
+	}
+	if ndjson {
+		return cfg.readNDJSON(c, func(line int, data []byte) error {
+			chair, reasons := parseChairJSON(data)
+			row(line, chair, reasons)
+			return nil
+		})
+	}
+	f, err := cfg.openUpload(c, "chairs")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cfg.readCSV(f, func(line int, rm *RecordMapper) error {
+		chair, reasons := parseChairRecord(rm)
+		row(line, chair, reasons)
+		return nil
+	})
+}
+
+// readEstates 物件のアップロードを Content-Type に合わせて読み、一件ずつ検証して row に渡す
+func (cfg csvImportConfig) readEstates(c echo.Context, row func(line int, estate Estate, reasons []string)) error {
+	ndjson, err := isNDJSONUpload(c)
+	if err != nil {
+		return err
+	}
+	if ndjson {
+		return cfg.readNDJSON(c, func(line int, data []byte) error {
+			estate, reasons := parseEstateJSON(data)
+			row(line, estate, reasons)
+			return nil
+		})
+	}
+	f, err := cfg.openUpload(c, "estates")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cfg.readCSV(f, func(line int, rm *RecordMapper) error {
+		estate, reasons := parseEstateRecord(rm)
+		row(line, estate, reasons)
+		return nil
+	})
+}
+
+// chairJSON NDJSON の一行の椅子。Chair の JSON では出さない popularity と stock も読む
+type chairJSON struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Thumbnail   string `json:"thumbnail"`
+	Price       int64  `json:"price"`
+	Height      int64  `json:"height"`
+	Width       int64  `json:"width"`
+	Depth       int64  `json:"depth"`
+	Color       string `json:"color"`
+	Features    string `json:"features"`
+	Kind        string `json:"kind"`
+	Popularity  int64  `json:"popularity"`
+	Stock       int64  `json:"stock"`
+}
+
+var chairJSONFields = []string{"id", "name", "description", "thumbnail", "price", "height", "width", "depth", "color", "features", "kind", "popularity", "stock"}
+
+// estateJSON NDJSON の一行の物件。Estate の JSON では出さない popularity も読む
+type estateJSON struct {
+	ID          int64   `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Thumbnail   string  `json:"thumbnail"`
+	Address     string  `json:"address"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	Rent        int64   `json:"rent"`
+	DoorHeight  int64   `json:"doorHeight"`
+	DoorWidth   int64   `json:"doorWidth"`
+	Features    string  `json:"features"`
+	Popularity  int64   `json:"popularity"`
+}
+
+var estateJSONFields = []string{"id", "name", "description", "thumbnail", "address", "latitude", "longitude", "rent", "doorHeight", "doorWidth", "features", "popularity"}
+
+// checkJSONFields data が fields を全て持ち、それ以外のフィールドを持たない JSON のオブジェクトかを確かめる
+func checkJSONFields(data []byte, fields []string) []string {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return []string{fmt.Sprintf("invalid json: %v", err)}
+	}
+	reasons := make([]string, 0)
+	known := make(map[string]bool, len(fields))
+	for _, name := range fields {
+		known[name] = true
+		if _, ok := object[name]; !ok {
+			reasons = append(reasons, fmt.Sprintf("missing field %q", name))
+		}
+	}
+	unknown := make([]string, 0)
+	for name := range object {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		reasons = append(reasons, fmt.Sprintf("unknown field %q", name))
+	}
+	return reasons
+}
+
+// parseChairJSON NDJSON の一行を椅子として読む。問題があれば全ての理由を返す
+func parseChairJSON(data []byte) (Chair, []string) {
+	if reasons := checkJSONFields(data, chairJSONFields); len(reasons) > 0 {
+		return Chair{}, reasons
+	}
+	var v chairJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return Chair{}, []string{err.Error()}
+	}
+	chair := Chair{
+		ID:          v.ID,
+		Name:        v.Name,
+		Description: v.Description,
+		Thumbnail:   v.Thumbnail,
+		Price:       v.Price,
+		Height:      v.Height,
+		Width:       v.Width,
+		Depth:       v.Depth,
+		Color:       v.Color,
+		Features:    v.Features,
+		Kind:        v.Kind,
+		Popularity:  v.Popularity,
+		Stock:       v.Stock,
+	}
+	return chair, validateChair(&chair)
+}
+
+// parseEstateJSON NDJSON の一行を物件として読む。問題があれば全ての理由を返す
+func parseEstateJSON(data []byte) (Estate, []string) {
+	if reasons := checkJSONFields(data, estateJSONFields); len(reasons) > 0 {
+		return Estate{}, reasons
+	}
+	var v estateJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return Estate{}, []string{err.Error()}
+	}
+	estate := Estate{
+		ID:          v.ID,
+		Name:        v.Name,
+		Description: v.Description,
+		Thumbnail:   v.Thumbnail,
+		Address:     v.Address,
+		Latitude:    v.Latitude,
+		Longitude:   v.Longitude,
+		Rent:        v.Rent,
+		DoorHeight:  v.DoorHeight,
+		DoorWidth:   v.DoorWidth,
+		Features:    v.Features,
+		Popularity:  v.Popularity,
+	}
+	return estate, validateEstate(&estate)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+func uploadNDJSON(e *echo.Echo, path, data string) *httptest.ResponseRecorder {
+	return doRequest(e, http.MethodPost, path, strings.NewReader(data), ndjsonContentType)
+}
+
+// chairJSONRow chairCSVRow と同じ椅子の NDJSON の一行
+func chairJSONRow(id, price, stock int64) string {
+	return jsonLine(map[string]interface{}{
+		"id": id, "name": fmt.Sprintf("椅子%v", id), "description": "説明", "thumbnail": fmt.Sprintf("/images/chair/%v.png", id),
+		"price": price, "height": 100, "width": 70, "depth": 60, "color": "黒", "features": "肘掛け付き", "kind": "座椅子",
+		"popularity": id, "stock": stock,
+	})
+}
+
+// estateJSONRow estateCSVRow と同じ物件の NDJSON の一行
+func estateJSONRow(id, rent, doorHeight, doorWidth int64, lat, lon float64) string {
+	return jsonLine(map[string]interface{}{
+		"id": id, "name": fmt.Sprintf("物件%v", id), "description": "説明", "thumbnail": fmt.Sprintf("/images/estate/%v.png", id),
+		"address": "東京都", "latitude": lat, "longitude": lon, "rent": rent, "doorHeight": doorHeight, "doorWidth": doorWidth,
+		"features": "最上階", "popularity": id,
+	})
+}
+
+func jsonLine(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(b) + "\n"
+}
+
+func chairJSONRows(from, to int64) string {
+	var rows strings.Builder
+	for id := from; id <= to; id++ {
+		rows.WriteString(chairJSONRow(id, 1000, 1))
+	}
+	return rows.String()
+}
+
+func TestUploadContentTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+	}{
+		{"ndjson", "application/x-ndjson", http.StatusCreated},
+		{"jsonl", "application/jsonl", http.StatusCreated},
+		{"jsonlines with charset", "application/x-jsonlines; charset=utf-8", http.StatusCreated},
+		{"json", "application/json", http.StatusUnsupportedMediaType},
+		{"plain text", "text/plain", http.StatusUnsupportedMediaType},
+		{"csv without a form", "text/csv", http.StatusUnsupportedMediaType},
+		{"missing", "", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, e := newTestServer(t)
+			expectStatus(t, doRequest(e, http.MethodPost, "/api/chair", strings.NewReader(chairJSONRow(1, 1000, 1)), tt.contentType), tt.status)
+			expectStatus(t, doRequest(e, http.MethodPost, "/api/estate", strings.NewReader(estateJSONRow(1, 50000, 100, 100, 35.6, 139.7)), tt.contentType), tt.status)
+
+			_, chairErr := s.chairs.GetChair(context.Background(), 1)
+			_, estateErr := s.estates.GetEstate(context.Background(), 1)
+			if stored := tt.status == http.StatusCreated; stored != (chairErr == nil) || stored != (estateErr == nil) {
+				t.Fatalf("chair: %v, estate: %v after status %v", chairErr, estateErr, tt.status)
+			}
+		})
+	}
+
+	t.Run("multipart", func(t *testing.T) {
+		s, e := newTestServer(t)
+		expectStatus(t, uploadCSV(e, "/api/chair", "chairs", chairCSVRow(1, 1000, 1)), http.StatusCreated)
+		if _, err := s.chairs.GetChair(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestNDJSONUploadReportsLineErrors(t *testing.T) {
+	s, e := newTestServer(t)
+
+	body := chairJSONRow(1, 1000, 1) +
+		"\n" +
+		`{"id": 2, "name": "椅子2"}` + "\n" +
+		"   \n" +
+		strings.Replace(chairJSONRow(3, 1000, 1), `"id":3`, `"id":3,"extra":true`, 1) +
+		"{not json}\n" +
+		chairJSONRow(4, 1000, 1)
+	rec := uploadNDJSON(e, "/api/chair", body)
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	var report ImportReport
+	decode(t, rec, &report)
+	if report.Rows != 5 || report.ErrorCount != 3 || len(report.Errors) != 3 {
+		t.Fatalf("report = %+v", report)
+	}
+	// 行番号は空行も数えたファイルの行番号
+	if lines := []int{report.Errors[0].Line, report.Errors[1].Line, report.Errors[2].Line}; !reflect.DeepEqual(lines, []int{3, 5, 6}) {
+		t.Fatalf("error lines = %v, want [3 5 6]", lines)
+	}
+	missing := report.Errors[0].Reasons
+	if len(missing) != len(chairJSONFields)-2 || missing[0] != `missing field "description"` {
+		t.Fatalf("missing field reasons = %q", missing)
+	}
+	if got := report.Errors[1].Reasons; !reflect.DeepEqual(got, []string{`unknown field "extra"`}) {
+		t.Fatalf("unknown field reasons = %q", got)
+	}
+	if got := report.Errors[2].Reasons; len(got) != 1 || !strings.HasPrefix(got[0], "invalid json") {
+		t.Fatalf("invalid json reasons = %q", got)
+	}
+
+	if _, err := s.chairs.GetChair(context.Background(), 1); err != ErrNotFound {
+		t.Fatalf("chair 1 was committed from a rejected upload: %v", err)
+	}
+}
+
+func TestNDJSONUploadLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  func(*csvImportConfig)
+	}{
+		{"row limit", func(cfg *csvImportConfig) { cfg.MaxRows = 10 }},
+		{"byte limit", func(cfg *csvImportConfig) { cfg.MaxBytes = int64(len(chairJSONRows(1, 10))) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, store, e := newBatchTestServer(t, 2)
+			tt.cfg(&s.csvImport)
+
+			expectStatus(t, uploadNDJSON(e, "/api/chair", chairJSONRows(1, 10)), http.StatusCreated)
+			expectStatus(t, uploadNDJSON(e, "/api/chair", chairJSONRows(11, 30)), http.StatusRequestEntityTooLarge)
+			if _, err := store.GetChair(context.Background(), 11); err != ErrNotFound {
+				t.Fatalf("chair 11 was committed from a rejected upload: %v", err)
+			}
+		})
+	}
+
+	t.Run("blank lines do not count as rows", func(t *testing.T) {
+		s, _, e := newBatchTestServer(t, 2)
+		s.csvImport.MaxRows = 2
+		expectStatus(t, uploadNDJSON(e, "/api/chair", "\n"+chairJSONRow(1, 1000, 1)+"\n\n"+chairJSONRow(2, 1000, 1)+"\n"), http.StatusCreated)
+	})
+
+	t.Run("body without a content length", func(t *testing.T) {
+		s, _, e := newBatchTestServer(t, 2)
+		s.csvImport.MaxBytes = 100
+		req := httptest.NewRequest(http.MethodPost, "/api/chair", strings.NewReader(chairJSONRows(1, 5)))
+		req.ContentLength = -1
+		req.Header.Set(echo.HeaderContentType, ndjsonContentType)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		expectStatus(t, rec, http.StatusRequestEntityTooLarge)
+	})
+}
+
+// NDJSON の取り込み結果は同じ内容の CSV の取り込み結果と一致する
+func TestNDJSONUploadReportMatchesCSV(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		field string
+		csv   string
+		json  string
+	}{
+		{
+			name: "chairs", path: "/api/chair", field: "chairs",
+			csv:  chairCSVRow(1, 1000, 1) + chairCSVRow(2, 2000, 3),
+			json: chairJSONRow(1, 1000, 1) + chairJSONRow(2, 2000, 3),
+		},
+		{
+			name: "chairs with errors", path: "/api/chair", field: "chairs",
+			csv:  chairCSVRow(1, 1000, 1) + chairCSVRow(2, -1, 3) + strings.Replace(chairCSVRow(3, 1000, 1), "黒", "虹色", 1),
+			json: chairJSONRow(1, 1000, 1) + chairJSONRow(2, -1, 3) + strings.Replace(chairJSONRow(3, 1000, 1), "黒", "虹色", 1),
+		},
+		{
+			name: "chairs dry run", path: "/api/chair?dryRun=true", field: "chairs",
+			csv:  chairCSVRow(1, 1000, 1),
+			json: chairJSONRow(1, 1000, 1),
+		},
+		{
+			name: "estates", path: "/api/estate", field: "estates",
+			csv:  estateCSVRow(1, 50000, 100, 100, 35.6812362, 139.7671248) + estateCSVRow(2, 80000, 200, 90, -33.8688, 151.2093),
+			json: estateJSONRow(1, 50000, 100, 100, 35.6812362, 139.7671248) + estateJSONRow(2, 80000, 200, 90, -33.8688, 151.2093),
+		},
+		{
+			name: "estates with errors", path: "/api/estate", field: "estates",
+			csv:  estateCSVRow(1, 50000, 100, 100, 91, 139.7) + estateCSVRow(2, -5, 200, 90, 35.6, 139.7),
+			json: estateJSONRow(1, 50000, 100, 100, 91, 139.7) + estateJSONRow(2, -5, 200, 90, 35.6, 139.7),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, csvEcho := newTestServer(t)
+			_, jsonEcho := newTestServer(t)
+			csvRec := uploadCSV(csvEcho, tt.path, tt.field, tt.csv)
+			jsonRec := uploadNDJSON(jsonEcho, tt.path, tt.json)
+			if csvRec.Code != jsonRec.Code {
+				t.Fatalf("status = %v, want %v as for CSV", jsonRec.Code, csvRec.Code)
+			}
+			var csvReport, jsonReport ImportReport
+			decode(t, csvRec, &csvReport)
+			decode(t, jsonRec, &jsonReport)
+			if !reflect.DeepEqual(jsonReport, csvReport) {
+				t.Fatalf("report = %s\nwant %s", jsonRec.Body.String(), csvRec.Body.String())
+			}
+		})
+	}
+}
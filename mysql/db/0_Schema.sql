@@ -3,6 +3,11 @@ CREATE DATABASE isuumo;
 
 DROP TABLE IF EXISTS isuumo.estate;
 DROP TABLE IF EXISTS isuumo.chair;
+DROP TABLE IF EXISTS isuumo.estate_feature;
+DROP TABLE IF EXISTS isuumo.chair_feature;
+DROP TABLE IF EXISTS isuumo.orders;
+DROP TABLE IF EXISTS isuumo.chair_reservation;
+DROP TABLE IF EXISTS isuumo.document_request;
 
 CREATE TABLE isuumo.estate
 (
@@ -17,6 +22,7 @@ CREATE TABLE isuumo.estate
     door_height INTEGER             NOT NULL,
     door_width  INTEGER             NOT NULL,
     features    VARCHAR(64)         NOT NULL,
+    features_mask BIGINT UNSIGNED   NOT NULL DEFAULT 0,
     popularity  INTEGER             NOT NULL
 );
 
@@ -32,6 +38,7 @@ CREATE TABLE isuumo.chair
     depth       INTEGER         NOT NULL,
     color       VARCHAR(64)     NOT NULL,
     features    VARCHAR(64)     NOT NULL,
+    features_mask BIGINT UNSIGNED NOT NULL DEFAULT 0,
     kind        VARCHAR(64)     NOT NULL,
     popularity  INTEGER         NOT NULL,
     stock       INTEGER         NOT NULL
@@ -73,3 +80,35 @@ ALTER TABLE estate ADD INDEX idx_estate_d_w (door_width);
 CREATE INDEX search_estate_rent ON estate (rent_range);
 CREATE INDEX search_estate_d_h ON estate (door_height_range);
 CREATE INDEX search_estate_d_w ON estate (door_width_range);
+
+CREATE TABLE isuumo.orders
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    chair_id    INTEGER         NOT NULL,
+    email       VARCHAR(256)    NOT NULL,
+    price       INTEGER         NOT NULL,
+    quantity    INTEGER         NOT NULL DEFAULT 1,
+    created_at  DATETIME(6)     NOT NULL,
+    KEY idx_email_id (email, id),
+    KEY idx_chair_id_id (chair_id, id)
+);
+
+CREATE TABLE isuumo.chair_reservation
+(
+    token       CHAR(32)        NOT NULL PRIMARY KEY,
+    chair_id    INTEGER         NOT NULL,
+    expires_at  DATETIME(6)     NOT NULL,
+    KEY idx_expires_at (expires_at)
+);
+
+CREATE TABLE isuumo.document_request
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    estate_id   INTEGER         NOT NULL,
+    email       VARCHAR(256)    NOT NULL,
+    status      VARCHAR(16)     NOT NULL DEFAULT 'pending',
+    created_at  DATETIME(6)     NOT NULL,
+    updated_at  DATETIME(6)     NOT NULL,
+    KEY idx_estate_id_email_created_at (estate_id, email, created_at),
+    KEY idx_status_id (status, id)
+);